@@ -2,13 +2,17 @@ package main
 
 import (
 	"context"
+	"strings"
 
 	"github.com/DeneesK/short-url/internal/app"
 	"github.com/DeneesK/short-url/internal/app/conf"
+	"github.com/DeneesK/short-url/internal/app/keyring"
 	"github.com/DeneesK/short-url/internal/app/logger"
 	"github.com/DeneesK/short-url/internal/app/repository"
 	"github.com/DeneesK/short-url/internal/app/router"
 	"github.com/DeneesK/short-url/internal/app/service"
+	"github.com/DeneesK/short-url/internal/app/storage/postgres"
+	"github.com/DeneesK/short-url/pkg/clientip"
 )
 
 func main() {
@@ -16,14 +20,40 @@ func main() {
 
 	log := logger.NewLogger(conf.Env)
 	defer log.Sync()
+
+	var dumpKeys *keyring.Keyring
+	var err error
+	if conf.DumpKeys != "" {
+		dumpKeys, err = keyring.Parse(conf.DumpKeys)
+	} else if conf.DumpKeyFile != "" {
+		dumpKeys, err = keyring.Load(conf.DumpKeyFile)
+	}
+	if err != nil {
+		log.Fatalf("failed to load dump encryption keys: %s", err)
+	}
+
 	rep, err := repository.NewRepository(
 		repository.StorageConfig{
-			DBDSN:           conf.DBDSN,
-			MaxStorageSize:  conf.MemoryUsageLimitBytes,
-			MigrationSource: conf.MigrationsPath,
+			DBDSN:               conf.DBDSN,
+			MaxStorageSize:      conf.MemoryUsageLimitBytes,
+			MigrationSource:     conf.MigrationsPath,
+			EvictionPolicy:      conf.EvictionPolicy,
+			SpillEvicted:        conf.SpillEvicted,
+			MemoryShards:        conf.MemoryShards,
+			DumpSync:            conf.DumpSync,
+			SnapshotCompression: conf.SnapshotCompression,
+			DumpKeys:            dumpKeys,
+			DBPool: postgres.PoolConfig{
+				MaxConns:          int32(conf.DBMaxConns),
+				MinConns:          int32(conf.DBMinConns),
+				MaxConnLifetime:   conf.DBMaxConnLifetime,
+				HealthCheckPeriod: conf.DBHealthCheckPeriod,
+			},
 		},
+		repository.WithLogger(log),
 		repository.AddDumpFile(conf.FileStoragePath),
 		repository.RestoreFromDump(conf.FileStoragePath),
+		repository.WithCache(conf.CacheSize, conf.CacheTTL),
 	)
 	if err != nil {
 		log.Fatalf("failed to initialized repository: %s", err)
@@ -32,9 +62,42 @@ func main() {
 	defer close()
 	defer rep.Close(ctx)
 
-	service := service.NewURLShortener(rep, conf.BaseURL)
-	router := router.NewRouter(service, log)
+	generator, err := service.NewAliasGenerator(conf.AliasStrategy, conf.AliasLength)
+	if err != nil {
+		log.Fatalf("failed to initialize alias generator: %s", err)
+	}
+	resolver, err := clientip.NewResolver(strings.Split(conf.TrustedProxies, ",")...)
+	if err != nil {
+		log.Fatalf("failed to parse trusted proxies: %s", err)
+	}
+	service := service.NewURLShortener(
+		rep, conf.BaseURL,
+		service.WithAliasGenerator(generator),
+		service.WithLogger(log),
+	)
+	defer service.Close()
+	router := router.NewRouter(
+		service, log, conf.SecretKey,
+		router.WithShortenRateLimit(conf.ShortenRateLimit, conf.ShortenBurst),
+		router.WithIssueRateLimit(conf.IssueRateLimit, conf.IssueBurst),
+		router.WithRedirectRateLimit(conf.RedirectRateLimit, conf.RedirectBurst),
+		router.WithIdempotency(rep, conf.IdempotencyWindow),
+		router.WithAdmin(rep, conf.AdminToken),
+		router.WithTrustedClients(conf.TrustedClientToken),
+		router.WithTrustedProxies(resolver),
+	)
 
-	app := app.NewApp(conf.ServerAddr, router, log)
+	// Only the in-memory storage is restored from the dump file, so only it
+	// needs compaction.
+	compactInterval := conf.CompactInterval
+	if conf.FileStoragePath == "" || conf.DBDSN != "" {
+		compactInterval = 0
+	}
+	app := app.NewApp(
+		conf.ServerAddr, router, log,
+		app.WithReaper(rep, conf.ReapInterval),
+		app.WithChangeListener(rep),
+		app.WithCompactor(rep, compactInterval),
+	)
 	app.Run()
 }
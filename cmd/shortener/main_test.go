@@ -3,20 +3,38 @@ package main
 import (
 	"bytes"
 	"context"
+	"encoding/base64"
+	"encoding/binary"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
 	"log"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
+	"github.com/DeneesK/short-url/internal/app/auth"
 	"github.com/DeneesK/short-url/internal/app/dto"
+	"github.com/DeneesK/short-url/internal/app/keyring"
+	"github.com/DeneesK/short-url/internal/app/metrics"
 	"github.com/DeneesK/short-url/internal/app/repository"
 	"github.com/DeneesK/short-url/internal/app/router"
+	"github.com/DeneesK/short-url/internal/app/router/middlewares"
 	"github.com/DeneesK/short-url/internal/app/service"
+	"github.com/DeneesK/short-url/internal/app/snapshot"
+	"github.com/DeneesK/short-url/internal/app/storage"
+	"github.com/DeneesK/short-url/internal/app/storage/memorystorage"
+	"github.com/DeneesK/short-url/internal/app/storage/postgres"
+	"github.com/DeneesK/short-url/internal/app/wal"
+	"github.com/DeneesK/short-url/pkg/clientip"
+	"github.com/DeneesK/short-url/pkg/validator"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
 	"github.com/stretchr/testify/require"
@@ -24,22 +42,24 @@ import (
 )
 
 const (
-	baseAddr = "http://localhosr:8000"
-	testID   = "test-id"
-	wrongID  = "wrong-id"
+	baseAddr   = "http://localhosr:8000"
+	testID     = "test-id"
+	wrongID    = "wrong-id"
+	testSecret = "test-secret"
 )
 
 type row struct {
 	ShortURL string `json:"short_url"`
 	LongURL  string `json:"long_url"`
+	UserID   string `json:"user_id,omitempty"`
 }
 
 type ShortenerURLServiceMock struct {
 	mock.Mock
 }
 
-func (m *ShortenerURLServiceMock) ShortenURL(ctx context.Context, value string) (string, error) {
-	args := m.Called(value)
+func (m *ShortenerURLServiceMock) ShortenURL(ctx context.Context, value string, opts dto.ShortenOptions) (string, error) {
+	args := m.Called(value, opts)
 	return args.String(0), args.Error(1)
 }
 
@@ -52,8 +72,30 @@ func (m *ShortenerURLServiceMock) PingDB(ctx context.Context) error {
 	return nil
 }
 
-func (m *ShortenerURLServiceMock) StoreBatchURL(ctx context.Context, batch []dto.OriginalURL) ([]dto.ShortedURL, error) {
-	return nil, nil
+func (m *ShortenerURLServiceMock) StoreBatchURL(ctx context.Context, batch []dto.OriginalURL, opts dto.BatchOptions) ([]dto.ShortedURL, error) {
+	args := m.Called(opts)
+	return args.Get(0).([]dto.ShortedURL), args.Error(1)
+}
+
+func (m *ShortenerURLServiceMock) FindByUser(ctx context.Context) ([]dto.UserURL, error) {
+	args := m.Called()
+	return args.Get(0).([]dto.UserURL), args.Error(1)
+}
+
+func (m *ShortenerURLServiceMock) DeleteUserURLs(ctx context.Context, aliases []string) error {
+	args := m.Called(aliases)
+	return args.Error(0)
+}
+
+func (m *ShortenerURLServiceMock) RecordClick(click dto.Click) {}
+
+func (m *ShortenerURLServiceMock) Stats(ctx context.Context, alias string, from, to time.Time) (dto.LinkStats, error) {
+	args := m.Called(alias)
+	return args.Get(0).(dto.LinkStats), args.Error(1)
+}
+
+func (m *ShortenerURLServiceMock) Diagnostics(ctx context.Context) dto.Diagnostics {
+	return dto.Diagnostics{}
 }
 
 func testRequest(t *testing.T, ts *httptest.Server, method, path string, body []byte) (*http.Response, string) {
@@ -77,13 +119,23 @@ func TestRouter(t *testing.T) {
 		log.Fatal(err)
 	}
 
-	rep.On("ShortenURL", "http://example.com").Return(testID, nil)
+	rep.On("ShortenURL", "http://example.com", dto.ShortenOptions{}).Return(testID, nil)
+	rep.On("ShortenURL", "http://example.com", dto.ShortenOptions{Alias: "taken"}).Return("", service.ErrAliasAlreadyTaken)
 	rep.On("FindByShortened", testID).Return("http://example.com", nil)
 	rep.On("FindByShortened", wrongID).Return("", errors.New("id not found"))
+	rep.On("FindByUser").Return([]dto.UserURL{}, nil)
+	rep.On("DeleteUserURLs", []string{testID}).Return(nil)
+	rep.On("Stats", testID).Return(dto.LinkStats{Alias: testID}, nil)
+	rep.On("Stats", wrongID).Return(dto.LinkStats{}, service.ErrForbidden)
+	rep.On("StoreBatchURL", dto.BatchOptions{}).Return([]dto.ShortedURL{
+		{ID: "1", URL: "http://localhost:8080/" + testID, Status: dto.StatusCreated},
+		{ID: "2", Status: dto.StatusInvalid, Error: "\"not-a-url\" is not valid url"},
+	}, nil)
+	rep.On("StoreBatchURL", dto.BatchOptions{Atomic: true}).Return([]dto.ShortedURL(nil), errors.New("\"not-a-url\" is not valid url"))
 
 	sugar := *logger.Sugar()
 
-	r := router.NewRouter(rep, &sugar)
+	r := router.NewRouter(rep, &sugar, testSecret)
 	ts := httptest.NewServer(r)
 	defer ts.Close()
 
@@ -136,6 +188,90 @@ func TestRouter(t *testing.T) {
 				code: http.StatusCreated,
 			},
 		},
+		{
+			name:   "get '/api/user/urls' without urls",
+			url:    "/api/user/urls",
+			method: http.MethodGet,
+			want: want{
+				code: http.StatusNoContent,
+			},
+		},
+		{
+			name:   "delete '/api/user/urls'",
+			url:    "/api/user/urls",
+			method: http.MethodDelete,
+			body:   []byte(`["test-id"]`),
+			want: want{
+				code: http.StatusAccepted,
+			},
+		},
+		{
+			name:   "post '/' with taken alias",
+			url:    "/?alias=taken",
+			method: http.MethodPost,
+			body:   []byte("http://example.com"),
+			want: want{
+				code: http.StatusConflict,
+			},
+		},
+		{
+			name:   "get '/api/stats/{id}'",
+			url:    "/api/stats/test-id?from=2026-01-01",
+			method: http.MethodGet,
+			want: want{
+				code: http.StatusOK,
+			},
+		},
+		{
+			name:   "get '/api/stats/{id}' of foreign url",
+			url:    "/api/stats/wrong-id",
+			method: http.MethodGet,
+			want: want{
+				code: http.StatusForbidden,
+			},
+		},
+		{
+			name:   "get '/api/stats/{id}' with invalid range",
+			url:    "/api/stats/test-id?from=yesterday",
+			method: http.MethodGet,
+			want: want{
+				code: http.StatusBadRequest,
+			},
+		},
+		{
+			name:   "get '/api/diagnostics' is not public",
+			url:    "/api/diagnostics",
+			method: http.MethodGet,
+			want: want{
+				code: http.StatusNotFound,
+			},
+		},
+		{
+			name:   "get '/metrics'",
+			url:    "/metrics",
+			method: http.MethodGet,
+			want: want{
+				code: http.StatusOK,
+			},
+		},
+		{
+			name:   "post '/api/shorten/batch' with invalid item",
+			url:    "/api/shorten/batch",
+			method: http.MethodPost,
+			body:   []byte(`[{"correlation_id":"1","original_url":"http://example.com"},{"correlation_id":"2","original_url":"not-a-url"}]`),
+			want: want{
+				code: http.StatusMultiStatus,
+			},
+		},
+		{
+			name:   "post '/api/shorten/batch' atomically with invalid item",
+			url:    "/api/shorten/batch?atomic=true",
+			method: http.MethodPost,
+			body:   []byte(`[{"correlation_id":"1","original_url":"http://example.com"},{"correlation_id":"2","original_url":"not-a-url"}]`),
+			want: want{
+				code: http.StatusBadRequest,
+			},
+		},
 		{
 			name:   "post '/api/shorten' empty body",
 			url:    "/api/shorten",
@@ -195,7 +331,7 @@ func TestRepository_Initializing(t *testing.T) {
 func TestRepository_Store(t *testing.T) {
 	repo, err := repository.NewRepository(repository.StorageConfig{})
 	assert.NoError(t, err)
-	_, err = repo.Store(context.TODO(), "id", "url")
+	_, err = repo.Store(context.TODO(), "id", "url", "", nil)
 	assert.NoError(t, err)
 }
 
@@ -203,7 +339,7 @@ func TestRepository_Get(t *testing.T) {
 	repo, err := repository.NewRepository(repository.StorageConfig{MaxStorageSize: 100_000})
 	assert.NoError(t, err)
 
-	_, err = repo.Store(context.TODO(), "id", "url")
+	_, err = repo.Store(context.TODO(), "id", "url", "", nil)
 	assert.NoError(t, err)
 
 	result, err := repo.Get(context.TODO(), "id")
@@ -212,6 +348,372 @@ func TestRepository_Get(t *testing.T) {
 	assert.Equal(t, "url", result)
 }
 
+func TestRepository_Cache(t *testing.T) {
+	repo, err := repository.NewRepository(
+		repository.StorageConfig{MaxStorageSize: 100_000},
+		repository.WithCache(2, time.Minute),
+	)
+	require.NoError(t, err)
+
+	_, err = repo.Get(context.TODO(), "id")
+	assert.ErrorIs(t, err, storage.ErrNotFound)
+
+	_, err = repo.Store(context.TODO(), "id", "url", "owner", nil)
+	require.NoError(t, err)
+	result, err := repo.Get(context.TODO(), "id")
+	assert.NoError(t, err, "negative entry is invalidated on store")
+	assert.Equal(t, "url", result)
+
+	require.NoError(t, repo.DeleteBatch(context.TODO(), "owner", []string{"id"}))
+	_, err = repo.Get(context.TODO(), "id")
+	assert.ErrorIs(t, err, storage.ErrDeleted, "entry is invalidated on delete")
+
+	expiresAt := time.Now().Add(50 * time.Millisecond)
+	_, err = repo.Store(context.TODO(), "short-lived", "url2", "", &expiresAt)
+	require.NoError(t, err)
+	result, err = repo.Get(context.TODO(), "short-lived")
+	assert.NoError(t, err)
+	assert.Equal(t, "url2", result)
+	time.Sleep(60 * time.Millisecond)
+	_, err = repo.Get(context.TODO(), "short-lived")
+	assert.ErrorIs(t, err, storage.ErrExpired, "cached entry honours link expiration")
+
+	w := httptest.NewRecorder()
+	metrics.Handler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	assert.Contains(t, w.Body.String(), `shortener_redirect_cache_requests_total{result="hit"}`)
+	assert.Contains(t, w.Body.String(), "shortener_redirect_cache_entries 2\n")
+}
+
+func storeLinks(s *memorystorage.MemoryStorage, ids ...string) error {
+	for _, id := range ids {
+		if _, err := s.Store(context.TODO(), id, "u"+id, "", nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// linksSize returns the memory taken by n links of single letter aliases
+// kept with policy.
+func linksSize(t *testing.T, policy memorystorage.EvictionPolicy, n int) uint64 {
+	s := memorystorage.NewMemoryStorage(0, memorystorage.WithEvictionPolicy(policy))
+	for i := 0; i < n; i++ {
+		require.NoError(t, storeLinks(s, string(rune('a'+i))))
+	}
+	return s.Stats().UsedBytes
+}
+
+func TestMemoryStorage_Eviction(t *testing.T) {
+	store := storeLinks
+	stored := func(s *memorystorage.MemoryStorage, id string) bool {
+		_, err := s.Get(context.TODO(), id)
+		return err == nil
+	}
+
+	t.Run("reject", func(t *testing.T) {
+		s := memorystorage.NewMemoryStorage(linksSize(t, memorystorage.EvictReject, 3), memorystorage.WithEvictionPolicy(memorystorage.EvictReject))
+		require.NoError(t, store(s, "a", "b", "c"))
+		assert.ErrorIs(t, store(s, "d"), storage.ErrStorageLimitExceeded)
+	})
+
+	t.Run("lru", func(t *testing.T) {
+		var evicted []string
+		s := memorystorage.NewMemoryStorage(linksSize(t, memorystorage.EvictLRU, 3),
+			memorystorage.WithEvictionPolicy(memorystorage.EvictLRU),
+			memorystorage.WithEvictionHandler(func(id string, link memorystorage.Evicted) {
+				evicted = append(evicted, id+"="+link.Value)
+			}),
+		)
+		require.NoError(t, store(s, "a", "b", "c"))
+		assert.True(t, stored(s, "a"))
+		require.NoError(t, store(s, "d"))
+
+		assert.Equal(t, []string{"b=ub"}, evicted)
+		assert.False(t, stored(s, "b"))
+		assert.True(t, stored(s, "c"))
+		require.NoError(t, store(s, "b"), "evicted value is free again")
+	})
+
+	t.Run("link larger than the limit", func(t *testing.T) {
+		for _, policy := range []memorystorage.EvictionPolicy{memorystorage.EvictLRU, memorystorage.EvictLFU} {
+			s := memorystorage.NewMemoryStorage(linksSize(t, policy, 3), memorystorage.WithEvictionPolicy(policy))
+			require.NoError(t, store(s, "a", "b", "c"))
+			_, err := s.Store(context.TODO(), "huge", strings.Repeat("u", 5000), "", nil)
+			assert.ErrorIs(t, err, storage.ErrStorageLimitExceeded)
+			assert.Equal(t, 3, s.Stats().Links, "nothing is evicted for a link that cannot fit")
+		}
+	})
+
+	t.Run("concurrent writers", func(t *testing.T) {
+		s := memorystorage.NewMemoryStorage(linksSize(t, memorystorage.EvictLRU, 3), memorystorage.WithEvictionPolicy(memorystorage.EvictLRU))
+		var wg sync.WaitGroup
+		for g := 0; g < 4; g++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for i := 0; i < 18; i++ {
+					assert.NoError(t, store(s, string(rune('0'+g*18+i))), "the room freed for a link is not taken by another writer")
+				}
+			}()
+		}
+		wg.Wait()
+		assert.LessOrEqual(t, s.Stats().UsedBytes, linksSize(t, memorystorage.EvictLRU, 3))
+	})
+
+	t.Run("lfu", func(t *testing.T) {
+		s := memorystorage.NewMemoryStorage(linksSize(t, memorystorage.EvictLFU, 3), memorystorage.WithEvictionPolicy(memorystorage.EvictLFU))
+		require.NoError(t, store(s, "a", "b", "c"))
+		for _, id := range []string{"a", "a", "b", "c", "c"} {
+			assert.True(t, stored(s, id))
+		}
+		require.NoError(t, store(s, "d"))
+
+		assert.False(t, stored(s, "b"))
+		assert.True(t, stored(s, "a"))
+		assert.True(t, stored(s, "c"))
+	})
+}
+
+func TestMemoryStorage_Accounting(t *testing.T) {
+	single := linksSize(t, memorystorage.EvictReject, 1)
+	s := memorystorage.NewMemoryStorage(single * 3)
+
+	require.NoError(t, storeLinks(s, "a", "b"))
+	assert.Equal(t, dto.MemoryStats{UsedBytes: single * 2, PeakBytes: single * 2, LimitBytes: single * 3, Links: 2}, s.Stats())
+
+	_, err := s.Store(context.TODO(), "c", strings.Repeat("x", int(single)), "", nil)
+	assert.ErrorIs(t, err, storage.ErrStorageLimitExceeded, "a write must not overshoot the limit")
+
+	require.NoError(t, storeLinks(s, "c"))
+	assert.Equal(t, single*3, s.Stats().UsedBytes)
+
+	owned := memorystorage.NewMemoryStorage(0)
+	past := time.Now().Add(-time.Second)
+	_, err = owned.Store(context.TODO(), "d", "https://owned.com", "owner", &past)
+	require.NoError(t, err)
+	_, err = owned.Store(context.TODO(), "e", "https://owned2.com", "owner", &past)
+	require.NoError(t, err)
+	peak := owned.Stats().UsedBytes
+	_, err = owned.PurgeExpired(context.TODO())
+	require.NoError(t, err)
+	assert.Equal(t, dto.MemoryStats{PeakBytes: peak}, owned.Stats(), "purging releases all memory of the links")
+
+	deleted := memorystorage.NewMemoryStorage(0)
+	long := "https://deleted.com/" + strings.Repeat("x", 100)
+	_, err = deleted.Store(context.TODO(), "f", long, "owner", nil)
+	require.NoError(t, err)
+	before := deleted.Stats().UsedBytes
+	require.NoError(t, deleted.DeleteBatch(context.TODO(), "owner", []string{"f"}))
+	assert.Less(t, deleted.Stats().UsedBytes, before-uint64(len(long)), "deleting releases the memory of the value")
+	_, err = deleted.Get(context.TODO(), "f")
+	assert.ErrorIs(t, err, storage.ErrDeleted, "the alias is kept as a tombstone")
+	owner, err := deleted.GetOwner(context.TODO(), "f")
+	require.NoError(t, err)
+	assert.Equal(t, "owner", owner)
+}
+
+func TestMemoryStorage_ShardedUniqueness(t *testing.T) {
+	s := memorystorage.NewMemoryStorage(0, memorystorage.WithShards(8))
+
+	var wg sync.WaitGroup
+	var created, violations, takenIDs atomic.Int32
+	for i := 0; i < 64; i++ {
+		wg.Add(2)
+		go func(i int) {
+			defer wg.Done()
+			_, err := s.Store(context.TODO(), fmt.Sprintf("alias-%d", i), "https://same.com", "", nil)
+			if err == nil {
+				created.Add(1)
+			} else if errors.Is(err, storage.ErrUniqueViolation) {
+				violations.Add(1)
+			}
+		}(i)
+		go func(i int) {
+			defer wg.Done()
+			_, err := s.Store(context.TODO(), "same-alias", fmt.Sprintf("https://other.com/%d", i), "", nil)
+			if errors.Is(err, storage.ErrNotUniqueID) {
+				takenIDs.Add(1)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	assert.Equal(t, int32(1), created.Load(), "a long url is stored once across shards")
+	assert.Equal(t, int32(63), violations.Load())
+	assert.Equal(t, int32(63), takenIDs.Load(), "an alias is stored once")
+	assert.Equal(t, 2, s.Stats().Links)
+}
+
+func TestRepository_SpillEvicted(t *testing.T) {
+	file, err := os.CreateTemp(t.TempDir(), "*.json")
+	require.NoError(t, err)
+	require.NoError(t, file.Close())
+
+	repo, err := repository.NewRepository(
+		repository.StorageConfig{MaxStorageSize: linksSize(t, memorystorage.EvictLRU, 3), EvictionPolicy: "lru", SpillEvicted: true},
+		repository.AddDumpFile(file.Name()),
+	)
+	require.NoError(t, err)
+	for _, id := range []string{"a", "b", "c", "d"} {
+		_, err := repo.Store(context.TODO(), id, "u"+id, "", nil)
+		require.NoError(t, err)
+	}
+	_, err = repo.Get(context.TODO(), "a")
+	assert.ErrorIs(t, err, storage.ErrNotFound)
+	require.NoError(t, repo.Close(context.TODO()))
+
+	dump, err := os.ReadFile(file.Name())
+	require.NoError(t, err)
+	assert.Contains(t, string(dump), `{"short_url":"a","long_url":"ua","is_evicted":true}`)
+
+	restored, err := repository.NewRepository(
+		repository.StorageConfig{MaxStorageSize: 100_000},
+		repository.RestoreFromDump(file.Name()),
+	)
+	require.NoError(t, err)
+	for _, id := range []string{"a", "b", "c", "d"} {
+		value, err := restored.Get(context.TODO(), id)
+		assert.NoError(t, err)
+		assert.Equal(t, "u"+id, value)
+	}
+
+	_, err = repository.NewRepository(repository.StorageConfig{EvictionPolicy: "fifo"})
+	assert.Error(t, err)
+}
+
+func TestRepository_PurgeExpired(t *testing.T) {
+	repo, err := repository.NewRepository(repository.StorageConfig{MaxStorageSize: 100_000})
+	assert.NoError(t, err)
+
+	past := time.Now().Add(-time.Second)
+	future := time.Now().Add(time.Hour)
+	_, err = repo.Store(context.TODO(), "expired", "url1", "", &past)
+	assert.NoError(t, err)
+	_, err = repo.Store(context.TODO(), "alive", "url2", "", &future)
+	assert.NoError(t, err)
+
+	_, err = repo.Get(context.TODO(), "expired")
+	assert.ErrorIs(t, err, storage.ErrExpired)
+
+	n, err := repo.PurgeExpired(context.TODO())
+	assert.NoError(t, err)
+	assert.Equal(t, 1, n)
+
+	result, err := repo.Get(context.TODO(), "alive")
+	assert.NoError(t, err)
+	assert.Equal(t, "url2", result)
+
+	_, err = repo.Store(context.TODO(), "expired", "url1", "", nil)
+	assert.NoError(t, err)
+}
+
+func TestRepository_StoreReplacesDeadRows(t *testing.T) {
+	path := t.TempDir() + "/dump.wal"
+	open := func(t *testing.T) *repository.Repository {
+		rep, err := repository.NewRepository(
+			repository.StorageConfig{MaxStorageSize: 100_000},
+			repository.AddDumpFile(path),
+			repository.RestoreFromDump(path),
+		)
+		require.NoError(t, err)
+		return rep
+	}
+	ctx := context.TODO()
+	past := time.Now().Add(-time.Second)
+
+	rep := open(t)
+	_, err := rep.Store(ctx, "expired", "url", "user", &past)
+	require.NoError(t, err)
+	alias, err := rep.Store(ctx, "fresh", "url", "user", nil)
+	require.NoError(t, err, "an expired row is replaced")
+	assert.Equal(t, "fresh", alias)
+
+	require.NoError(t, rep.DeleteBatch(ctx, "user", []string{"fresh"}))
+	alias, err = rep.Store(ctx, "again", "url", "user", nil)
+	require.NoError(t, err, "a deleted row is replaced")
+	assert.Equal(t, "again", alias)
+
+	alias, err = rep.Store(ctx, "other", "url", "user", nil)
+	assert.ErrorIs(t, err, storage.ErrUniqueViolation, "a live row is kept")
+	assert.Equal(t, "again", alias)
+
+	assertGone := func(t *testing.T, rep *repository.Repository) {
+		for _, id := range []string{"expired", "fresh"} {
+			_, err := rep.Get(ctx, id)
+			assert.ErrorIs(t, err, storage.ErrDeleted, "%s is gone, not unknown", id)
+			owner, err := rep.GetOwner(ctx, id)
+			assert.NoError(t, err)
+			assert.Equal(t, "user", owner)
+		}
+		result, err := rep.Get(ctx, "again")
+		assert.NoError(t, err)
+		assert.Equal(t, "url", result)
+	}
+	assertGone(t, rep)
+
+	// The snapshot keeps the dead rows along with the live one.
+	_, err = rep.Compact(ctx)
+	require.NoError(t, err)
+	require.NoError(t, rep.Close(ctx))
+	rep = open(t)
+	defer rep.Close(ctx)
+	assertGone(t, rep)
+}
+
+// TestPostgresStorage_StoreReplacesDeadRows runs against the database at
+// TEST_DATABASE_DSN.
+func TestPostgresStorage_StoreReplacesDeadRows(t *testing.T) {
+	dsn := os.Getenv("TEST_DATABASE_DSN")
+	if dsn == "" {
+		t.Skip("TEST_DATABASE_DSN is not set")
+	}
+	ctx := context.Background()
+	db := postgres.NewDBConnection(ctx, dsn, postgres.PoolConfig{},
+		postgres.RunMigrations("file://../../migrations", dsn))
+	defer db.Close(ctx)
+
+	suffix := strconv.FormatInt(time.Now().UnixNano(), 36)
+	url := "https://example.com/" + suffix
+	past := time.Now().Add(-time.Second)
+
+	alias, err := db.Store(ctx, "expired"+suffix, url, "user", &past)
+	require.NoError(t, err)
+	assert.Equal(t, "expired"+suffix, alias)
+
+	alias, err = db.Store(ctx, "fresh"+suffix, url, "user", nil)
+	require.NoError(t, err, "an expired row is replaced")
+	assert.Equal(t, "fresh"+suffix, alias)
+	_, err = db.Get(ctx, "expired"+suffix)
+	assert.ErrorIs(t, err, storage.ErrDeleted, "the replaced alias is gone, not unknown")
+
+	require.NoError(t, db.DeleteBatch(ctx, "user", []string{"fresh" + suffix}))
+	alias, err = db.Store(ctx, "again"+suffix, url, "user", nil)
+	require.NoError(t, err, "a deleted row is replaced")
+	assert.Equal(t, "again"+suffix, alias)
+	_, err = db.Get(ctx, "fresh"+suffix)
+	assert.ErrorIs(t, err, storage.ErrDeleted)
+	owner, err := db.GetOwner(ctx, "fresh"+suffix)
+	require.NoError(t, err)
+	assert.Equal(t, "user", owner)
+
+	alias, err = db.Store(ctx, "other"+suffix, url, "user", nil)
+	assert.ErrorIs(t, err, storage.ErrUniqueViolation, "a live row is kept")
+	assert.Equal(t, "again"+suffix, alias)
+
+	results, err := db.StoreBatch(ctx, []dto.OriginalURL{{ID: "1", URL: url, Alias: "batch" + suffix}}, "user", false)
+	require.NoError(t, err)
+	assert.Equal(t, "again"+suffix, results[0].Alias)
+	assert.True(t, results[0].Existing)
+
+	require.NoError(t, db.DeleteBatch(ctx, "user", []string{"again" + suffix}))
+	results, err = db.StoreBatch(ctx, []dto.OriginalURL{{ID: "1", URL: url, Alias: "batch" + suffix}}, "user", false)
+	require.NoError(t, err)
+	assert.Equal(t, "batch"+suffix, results[0].Alias)
+	assert.False(t, results[0].Existing)
+	_, err = db.Get(ctx, "again"+suffix)
+	assert.ErrorIs(t, err, storage.ErrDeleted)
+}
+
 func TestRepository_StoreToFile(t *testing.T) {
 	tempDir := os.TempDir()
 	file, err := os.CreateTemp(tempDir, "*.json")
@@ -220,15 +722,17 @@ func TestRepository_StoreToFile(t *testing.T) {
 
 	repo, err := repository.NewRepository(repository.StorageConfig{MaxStorageSize: 100_000}, repository.AddDumpFile(file.Name()))
 	assert.NoError(t, err)
-	_, err = repo.Store(context.TODO(), "short", "long")
+	_, err = repo.Store(context.TODO(), "short", "long", "user", nil)
 	assert.NoError(t, err)
 
 	var storedRow row
-	decoder := json.NewDecoder(file)
-	err = decoder.Decode(&storedRow)
+	_, err = wal.Replay(file.Name(), func(data []byte) error {
+		return json.Unmarshal(data, &storedRow)
+	})
 	assert.NoError(t, err)
 	assert.Equal(t, "short", storedRow.ShortURL)
 	assert.Equal(t, "long", storedRow.LongURL)
+	assert.Equal(t, "user", storedRow.UserID)
 }
 
 func TestRepository_RestoreFromDump(t *testing.T) {
@@ -238,8 +742,8 @@ func TestRepository_RestoreFromDump(t *testing.T) {
 	defer os.Remove(file.Name())
 
 	rows := []row{
-		{"short1", "long1"},
-		{"short2", "long2"},
+		{"short1", "long1", ""},
+		{"short2", "long2", "user"},
 	}
 	for _, r := range rows {
 		data, _ := json.Marshal(r)
@@ -256,51 +760,1383 @@ func TestRepository_RestoreFromDump(t *testing.T) {
 	assert.Equal(t, "long1", result)
 }
 
-func TestRepository_Close(t *testing.T) {
-	tempDir := os.TempDir()
-	file, err := os.CreateTemp(tempDir, "*.json")
-	assert.NoError(t, err)
-	defer os.Remove(file.Name())
+func TestWAL(t *testing.T) {
+	newLog := func(t *testing.T, payloads ...string) string {
+		path := t.TempDir() + "/dump.wal"
+		w, err := wal.OpenWriter(path, wal.SyncAlways)
+		require.NoError(t, err)
+		for _, p := range payloads {
+			require.NoError(t, w.Append([]byte(p)))
+		}
+		require.NoError(t, w.Close())
+		return path
+	}
+	replay := func(t *testing.T, path string) ([]string, int64) {
+		var payloads []string
+		truncated, err := wal.Replay(path, func(data []byte) error {
+			payloads = append(payloads, string(data))
+			return nil
+		})
+		require.NoError(t, err)
+		return payloads, truncated
+	}
 
-	repo, err := repository.NewRepository(repository.StorageConfig{MaxStorageSize: 100_000}, repository.AddDumpFile(file.Name()))
-	assert.NoError(t, err)
+	t.Run("round trip", func(t *testing.T) {
+		path := newLog(t, `{"a":1}`, `{"b":2}`)
+		payloads, truncated := replay(t, path)
+		assert.Equal(t, []string{`{"a":1}`, `{"b":2}`}, payloads)
+		assert.Zero(t, truncated)
+	})
 
-	err = repo.Close(context.TODO())
-	assert.NoError(t, err)
-}
+	t.Run("torn tail is truncated", func(t *testing.T) {
+		path := newLog(t, `{"a":1}`, `{"b":2}`)
+		info, err := os.Stat(path)
+		require.NoError(t, err)
+		require.NoError(t, os.Truncate(path, info.Size()-3))
 
-func TestURLShortenerService(t *testing.T) {
-	longValidURL := "https://validurl.com"
-	longValidURL2 := "https://validurl2.com"
-	longNOTValidURL := "NOT valid url.com"
-	repo, err := repository.NewRepository(repository.StorageConfig{MaxStorageSize: 100_000})
-	assert.NoError(t, err)
+		payloads, truncated := replay(t, path)
+		assert.Equal(t, []string{`{"a":1}`}, payloads)
+		assert.Equal(t, int64(12+len(`{"b":2}`)-3), truncated)
 
-	ser := service.NewURLShortener(repo, baseAddr)
+		// The log can be appended to after recovery.
+		w, err := wal.OpenWriter(path, wal.SyncNever)
+		require.NoError(t, err)
+		require.NoError(t, w.Append([]byte(`{"c":3}`)))
+		require.NoError(t, w.Close())
+		payloads, truncated = replay(t, path)
+		assert.Equal(t, []string{`{"a":1}`, `{"c":3}`}, payloads)
+		assert.Zero(t, truncated)
+	})
 
-	t.Run("Shorten valid url", func(t *testing.T) {
-		shortURL, err := ser.ShortenURL(context.TODO(), longValidURL)
-		assert.NoError(t, err)
-		assert.NotEqual(t, shortURL, longValidURL)
-		assert.Contains(t, shortURL, baseAddr)
+	t.Run("corrupt record is truncated", func(t *testing.T) {
+		path := newLog(t, `{"a":1}`, `{"b":2}`)
+		data, err := os.ReadFile(path)
+		require.NoError(t, err)
+		data[len(data)-2] ^= 0xff
+		require.NoError(t, os.WriteFile(path, data, 0644))
+
+		payloads, truncated := replay(t, path)
+		assert.Equal(t, []string{`{"a":1}`}, payloads)
+		assert.Equal(t, int64(12+len(`{"b":2}`)), truncated)
 	})
 
-	t.Run("Shorten NOT valid url", func(t *testing.T) {
-		_, err := ser.ShortenURL(context.TODO(), longNOTValidURL)
-		assert.Error(t, err)
+	t.Run("corrupt record in the middle fails", func(t *testing.T) {
+		path := newLog(t, `{"a":1}`, `{"b":2}`, `{"c":3}`)
+		data, err := os.ReadFile(path)
+		require.NoError(t, err)
+		second := int64(12 + len(`{"a":1}`))
+		data[second+12] ^= 0xff
+		require.NoError(t, os.WriteFile(path, data, 0644))
+
+		_, err = wal.Replay(path, func([]byte) error { return nil })
+		assert.ErrorIs(t, err, wal.ErrCorrupt)
+		assert.ErrorContains(t, err, fmt.Sprintf("offset %d", second))
+		after, err := os.ReadFile(path)
+		require.NoError(t, err)
+		assert.Equal(t, data, after, "the log is left as it is")
+
+		_, err = repository.NewRepository(repository.StorageConfig{MaxStorageSize: 100}, repository.RestoreFromDump(path))
+		assert.ErrorIs(t, err, wal.ErrCorrupt)
 	})
 
-	t.Run("Shorten EXISTS valid long url", func(t *testing.T) {
-		_, err := ser.ShortenURL(context.TODO(), longValidURL)
-		assert.ErrorIs(t, service.ErrLongURLAlreadyExists, err)
+	t.Run("corrupt length in the middle fails", func(t *testing.T) {
+		for name, length := range map[string]uint32{"longer than the log": 1000, "too large": wal.MaxRecordSize + 1} {
+			t.Run(name, func(t *testing.T) {
+				path := newLog(t, `{"a":1}`, `{"b":2}`, `{"c":3}`)
+				data, err := os.ReadFile(path)
+				require.NoError(t, err)
+				second := 12 + len(`{"a":1}`)
+				binary.BigEndian.PutUint32(data[second:], length)
+				require.NoError(t, os.WriteFile(path, data, 0644))
+
+				var payloads []string
+				_, err = wal.Replay(path, func(data []byte) error {
+					payloads = append(payloads, string(data))
+					return nil
+				})
+				assert.ErrorIs(t, err, wal.ErrCorrupt)
+				assert.ErrorContains(t, err, fmt.Sprintf("offset %d", second))
+				assert.Equal(t, []string{`{"a":1}`}, payloads)
+				after, err := os.ReadFile(path)
+				require.NoError(t, err)
+				assert.Equal(t, data, after, "the log is left as it is")
+			})
+		}
 	})
 
-	t.Run("Find by Alias(Shortened)", func(t *testing.T) {
-		shortURL, err := ser.ShortenURL(context.TODO(), longValidURL2)
-		assert.NoError(t, err)
-		id := (strings.Split(shortURL, baseAddr+"/"))[1]
-		res, err := ser.FindByShortened(context.TODO(), id)
-		assert.NoError(t, err)
-		assert.Equal(t, longValidURL2, res)
+	t.Run("json lines are replayed", func(t *testing.T) {
+		path := t.TempDir() + "/dump.json"
+		require.NoError(t, os.WriteFile(path, []byte("{\"a\":1}\n{\"b\":2}\n{\"c\""), 0644))
+		w, err := wal.OpenWriter(path, wal.SyncEvery(time.Millisecond))
+		require.NoError(t, err)
+		// The torn line is cut off before the log is appended to.
+		_, truncated := replay(t, path)
+		assert.Equal(t, int64(len(`{"c"`)), truncated)
+		require.NoError(t, w.Append([]byte(`{"d":4}`)))
+		require.NoError(t, w.Close())
+
+		payloads, _ := replay(t, path)
+		assert.Equal(t, []string{`{"a":1}`, `{"b":2}`, `{"d":4}`}, payloads)
+	})
+
+	t.Run("sync policy", func(t *testing.T) {
+		for policy, want := range map[string]wal.SyncPolicy{
+			"always": wal.SyncAlways,
+			"never":  wal.SyncNever,
+			"100ms":  wal.SyncEvery(100 * time.Millisecond),
+		} {
+			got, err := wal.ParseSyncPolicy(policy)
+			assert.NoError(t, err)
+			assert.Equal(t, want, got)
+		}
+		_, err := wal.ParseSyncPolicy("sometimes")
+		assert.Error(t, err)
 	})
 }
+
+func TestRepository_RestoreTornDump(t *testing.T) {
+	path := t.TempDir() + "/dump.wal"
+	rep, err := repository.NewRepository(repository.StorageConfig{MaxStorageSize: 100_000, DumpSync: "always"}, repository.AddDumpFile(path))
+	require.NoError(t, err)
+	_, err = rep.Store(context.TODO(), "short1", "long1", "", nil)
+	require.NoError(t, err)
+	_, err = rep.Store(context.TODO(), "short2", "long2", "", nil)
+	require.NoError(t, err)
+	require.NoError(t, rep.Close(context.TODO()))
+
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+	require.NoError(t, os.Truncate(path, info.Size()-1))
+
+	rep, err = repository.NewRepository(
+		repository.StorageConfig{MaxStorageSize: 100_000},
+		repository.AddDumpFile(path),
+		repository.RestoreFromDump(path),
+	)
+	require.NoError(t, err)
+	defer rep.Close(context.TODO())
+
+	result, err := rep.Get(context.TODO(), "short1")
+	assert.NoError(t, err)
+	assert.Equal(t, "long1", result)
+	_, err = rep.Get(context.TODO(), "short2")
+	assert.ErrorIs(t, err, storage.ErrNotFound)
+}
+
+func TestRepository_Compact(t *testing.T) {
+	path := t.TempDir() + "/dump.wal"
+	open := func(t *testing.T) *repository.Repository {
+		rep, err := repository.NewRepository(
+			repository.StorageConfig{MaxStorageSize: 100_000},
+			repository.AddDumpFile(path),
+			repository.RestoreFromDump(path),
+		)
+		require.NoError(t, err)
+		return rep
+	}
+
+	rep := open(t)
+	for i := 0; i < 10; i++ {
+		_, err := rep.Store(context.TODO(), fmt.Sprintf("short%d", i), fmt.Sprintf("long%d", i), "user", nil)
+		require.NoError(t, err)
+	}
+	require.NoError(t, rep.DeleteBatch(context.TODO(), "user", []string{"short0"}))
+
+	compaction, err := rep.Compact(context.TODO())
+	require.NoError(t, err)
+	assert.Equal(t, 10, compaction.Links)
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+	assert.Zero(t, info.Size(), "the dump starts afresh")
+	_, err = os.Stat(path + ".next")
+	assert.ErrorIs(t, err, os.ErrNotExist)
+
+	_, err = rep.Store(context.TODO(), "after", "long-after", "user", nil)
+	require.NoError(t, err)
+	require.NoError(t, rep.Close(context.TODO()))
+
+	rep = open(t)
+	defer rep.Close(context.TODO())
+	for _, id := range []string{"short1", "short9", "after"} {
+		_, err := rep.Get(context.TODO(), id)
+		assert.NoError(t, err, id)
+	}
+	_, err = rep.Get(context.TODO(), "short0")
+	assert.ErrorIs(t, err, storage.ErrDeleted)
+}
+
+func TestRepository_CompactWhileWriting(t *testing.T) {
+	path := t.TempDir() + "/dump.wal"
+	open := func(t *testing.T) *repository.Repository {
+		rep, err := repository.NewRepository(
+			repository.StorageConfig{MaxStorageSize: 1_000_000},
+			repository.AddDumpFile(path),
+			repository.RestoreFromDump(path),
+		)
+		require.NoError(t, err)
+		return rep
+	}
+
+	rep := open(t)
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 500; i++ {
+			_, err := rep.Store(context.TODO(), fmt.Sprintf("short%d", i), fmt.Sprintf("long%d", i), "user", nil)
+			assert.NoError(t, err)
+			if i%10 == 0 {
+				assert.NoError(t, rep.DeleteBatch(context.TODO(), "user", []string{fmt.Sprintf("short%d", i)}))
+			}
+		}
+	}()
+	for i := 0; i < 5; i++ {
+		_, err := rep.Compact(context.TODO())
+		require.NoError(t, err)
+	}
+	wg.Wait()
+	require.NoError(t, rep.Close(context.TODO()))
+
+	rep = open(t)
+	defer rep.Close(context.TODO())
+	for i := 0; i < 500; i++ {
+		_, err := rep.Get(context.TODO(), fmt.Sprintf("short%d", i))
+		if i%10 == 0 {
+			assert.ErrorIs(t, err, storage.ErrDeleted, i)
+		} else {
+			assert.NoError(t, err, i)
+		}
+	}
+}
+
+func TestRepository_RestoreInterruptedCompaction(t *testing.T) {
+	path := t.TempDir() + "/dump.wal"
+	// A crash after switching to a new segment leaves both segments behind.
+	for file, payload := range map[string]string{
+		path:           `{"short_url":"short1","long_url":"long1"}`,
+		path + ".next": `{"short_url":"short2","long_url":"long2"}`,
+	} {
+		w, err := wal.OpenWriter(file, wal.SyncNever)
+		require.NoError(t, err)
+		require.NoError(t, w.Append([]byte(payload)))
+		require.NoError(t, w.Close())
+	}
+
+	rep, err := repository.NewRepository(
+		repository.StorageConfig{MaxStorageSize: 100_000},
+		repository.AddDumpFile(path),
+		repository.RestoreFromDump(path),
+	)
+	require.NoError(t, err)
+	defer rep.Close(context.TODO())
+
+	for _, id := range []string{"short1", "short2"} {
+		_, err := rep.Get(context.TODO(), id)
+		assert.NoError(t, err, id)
+	}
+	_, err = os.Stat(path + ".next")
+	assert.ErrorIs(t, err, os.ErrNotExist, "the compaction is finished")
+	_, err = os.Stat(path + ".snapshot")
+	assert.NoError(t, err)
+
+	memRep, err := repository.NewRepository(repository.StorageConfig{MaxStorageSize: 100_000})
+	require.NoError(t, err)
+	_, err = memRep.Compact(context.TODO())
+	assert.ErrorIs(t, err, storage.ErrCompactionUnsupported, "nothing to compact without a dump file")
+}
+
+func TestSnapshot(t *testing.T) {
+	expiresAt := time.Date(2030, 1, 2, 3, 4, 5, 6, time.UTC)
+	rows := []snapshot.Row{
+		{ShortURL: "short1", LongURL: "https://a.com", UserID: "user"},
+		{ShortURL: "short2", LongURL: "https://b.com/" + strings.Repeat("x", 100_000), Deleted: true},
+		{ShortURL: "short3", LongURL: "https://c.com", ExpiresAt: &expiresAt, Evicted: true},
+	}
+	keys, err := keyring.Parse(testDumpKeys(1))
+	require.NoError(t, err)
+	write := func(t *testing.T, compression snapshot.Compression, c snapshot.Cipher) string {
+		path := t.TempDir() + "/dump.snapshot"
+		w, err := snapshot.Create(path, compression, c)
+		require.NoError(t, err)
+		for _, r := range rows {
+			require.NoError(t, w.Write(r))
+		}
+		require.NoError(t, w.Close())
+		return path
+	}
+	read := func(path string, c snapshot.Cipher) ([]snapshot.Row, error) {
+		file, err := os.Open(path)
+		require.NoError(t, err)
+		defer file.Close()
+		var read []snapshot.Row
+		err = snapshot.Read(file, c, func(r snapshot.Row) error {
+			read = append(read, r)
+			return nil
+		})
+		return read, err
+	}
+
+	for _, compression := range []snapshot.Compression{snapshot.CompressionNone, snapshot.CompressionGzip, snapshot.CompressionZstd} {
+		t.Run(compression.String(), func(t *testing.T) {
+			read, err := read(write(t, compression, nil), nil)
+			require.NoError(t, err)
+			assert.Equal(t, rows, read)
+
+			parsed, err := snapshot.ParseCompression(compression.String())
+			assert.NoError(t, err)
+			assert.Equal(t, compression, parsed)
+		})
+	}
+
+	t.Run("encrypted", func(t *testing.T) {
+		path := write(t, snapshot.CompressionZstd, keys)
+		got, err := read(path, keys)
+		require.NoError(t, err)
+		assert.Equal(t, rows, got)
+
+		_, err = read(path, nil)
+		assert.ErrorIs(t, err, snapshot.ErrEncrypted)
+
+		data, err := os.ReadFile(path)
+		require.NoError(t, err)
+		require.NoError(t, os.WriteFile(path, data[:len(data)-1], 0644))
+		_, err = read(path, keys)
+		assert.ErrorIs(t, err, snapshot.ErrCorrupt)
+	})
+
+	t.Run("corrupt", func(t *testing.T) {
+		path := write(t, snapshot.CompressionNone, nil)
+		data, err := os.ReadFile(path)
+		require.NoError(t, err)
+		data[len(data)-1] ^= 0xff
+		require.NoError(t, os.WriteFile(path, data, 0644))
+		_, err = read(path, nil)
+		assert.ErrorIs(t, err, snapshot.ErrCorrupt)
+
+		require.NoError(t, os.WriteFile(path, data[:len(data)-10], 0644))
+		_, err = read(path, nil)
+		assert.ErrorIs(t, err, snapshot.ErrCorrupt)
+
+		// A row that still parses is caught by the checksum before any
+		// row is applied.
+		data[len(data)-1] ^= 0xff
+		data[bytes.Index(data, []byte("https://a.com"))+8] = 'z'
+		require.NoError(t, os.WriteFile(path, data, 0644))
+		applied, err := read(path, nil)
+		assert.ErrorIs(t, err, snapshot.ErrCorrupt)
+		assert.Empty(t, applied)
+	})
+
+	t.Run("newer version", func(t *testing.T) {
+		path := write(t, snapshot.CompressionNone, nil)
+		data, err := os.ReadFile(path)
+		require.NoError(t, err)
+		data[9] = snapshot.Version + 1
+		require.NoError(t, os.WriteFile(path, data, 0644))
+		_, err = read(path, nil)
+		assert.ErrorIs(t, err, snapshot.ErrUnsupportedVersion)
+	})
+
+	t.Run("not a snapshot", func(t *testing.T) {
+		path := t.TempDir() + "/dump.json"
+		require.NoError(t, os.WriteFile(path, []byte(`{"short_url":"short1","long_url":"long1"}`+"\n"), 0644))
+		_, err := read(path, nil)
+		assert.ErrorIs(t, err, snapshot.ErrNotSnapshot)
+	})
+
+	_, err = snapshot.ParseCompression("lz4")
+	assert.Error(t, err)
+}
+
+func TestRepository_RestoreLegacySnapshot(t *testing.T) {
+	path := t.TempDir() + "/dump.json"
+	// Snapshots used to have the format of the dump file.
+	require.NoError(t, os.WriteFile(path+".snapshot", []byte(`{"short_url":"short1","long_url":"long1"}`+"\n"), 0644))
+
+	rep, err := repository.NewRepository(
+		repository.StorageConfig{MaxStorageSize: 100_000, SnapshotCompression: "gzip"},
+		repository.AddDumpFile(path),
+		repository.RestoreFromDump(path),
+	)
+	require.NoError(t, err)
+	defer rep.Close(context.TODO())
+	result, err := rep.Get(context.TODO(), "short1")
+	require.NoError(t, err)
+	assert.Equal(t, "long1", result)
+
+	// Compaction rewrites it in the binary format.
+	_, err = rep.Compact(context.TODO())
+	require.NoError(t, err)
+	file, err := os.Open(path + ".snapshot")
+	require.NoError(t, err)
+	defer file.Close()
+	assert.NoError(t, snapshot.Read(file, nil, func(r snapshot.Row) error {
+		assert.Equal(t, "short1", r.ShortURL)
+		return nil
+	}))
+}
+
+// testDumpKeys returns keys with ids from 1 to n, the last one current.
+func testDumpKeys(n int) string {
+	keys := make([]string, 0, n)
+	for id := 1; id <= n; id++ {
+		key := bytes.Repeat([]byte{byte(id)}, 32)
+		keys = append(keys, fmt.Sprintf("%d:%s", id, base64.StdEncoding.EncodeToString(key)))
+	}
+	return strings.Join(keys, ",")
+}
+
+func TestKeyring(t *testing.T) {
+	oldKeys, err := keyring.Parse(testDumpKeys(1))
+	require.NoError(t, err)
+	keys, err := keyring.Parse(testDumpKeys(2))
+	require.NoError(t, err)
+	assert.Equal(t, uint32(2), keys.KeyID())
+
+	sealed := oldKeys.Seal([]byte("secret"), []byte("ad"))
+	assert.True(t, keyring.IsSealed(sealed))
+	opened, err := keys.Open(sealed, []byte("ad"))
+	require.NoError(t, err)
+	assert.Equal(t, "secret", string(opened), "rotated keys open data sealed before")
+
+	_, err = keys.Open(sealed, []byte("other"))
+	assert.Error(t, err)
+	_, err = oldKeys.Open(keys.Seal([]byte("secret"), nil), nil)
+	assert.ErrorIs(t, err, keyring.ErrUnknownKey)
+
+	for _, invalid := range []string{"", "1", "x:AAAA", "1:not base64", "1:AAAA", testDumpKeys(1) + "," + testDumpKeys(1)} {
+		_, err := keyring.Parse(invalid)
+		assert.Error(t, err, invalid)
+	}
+}
+
+func TestRepository_DumpEncryption(t *testing.T) {
+	path := t.TempDir() + "/dump.wal"
+	// A dump written before encryption is enabled stays readable.
+	require.NoError(t, os.WriteFile(path, []byte(`{"short_url":"plain","long_url":"https://plain.com"}`+"\n"), 0644))
+
+	open := func(t *testing.T, keys string) (*repository.Repository, error) {
+		var dumpKeys *keyring.Keyring
+		if keys != "" {
+			var err error
+			dumpKeys, err = keyring.Parse(keys)
+			require.NoError(t, err)
+		}
+		return repository.NewRepository(
+			repository.StorageConfig{MaxStorageSize: 100_000, DumpKeys: dumpKeys},
+			repository.AddDumpFile(path),
+			repository.RestoreFromDump(path),
+		)
+	}
+
+	assertSealed := func(t *testing.T) {
+		for _, file := range []string{path, path + ".snapshot"} {
+			data, err := os.ReadFile(file)
+			require.NoError(t, err)
+			assert.NotContains(t, string(data), "secret")
+			assert.NotContains(t, string(data), "plain.com")
+		}
+	}
+
+	// The plain dump is sealed as soon as it is restored with a key.
+	rep, err := open(t, testDumpKeys(1))
+	require.NoError(t, err)
+	_, err = rep.Store(context.TODO(), "first", "https://a.com/?token=secret1", "", nil)
+	require.NoError(t, err)
+	require.NoError(t, rep.Close(context.TODO()))
+	assertSealed(t)
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm(), "an existing dump is made private")
+
+	// Rotated keys read with both keys and seal everything under the new
+	// one, so the old key is not needed afterwards.
+	rep, err = open(t, testDumpKeys(2))
+	require.NoError(t, err)
+	_, err = rep.Store(context.TODO(), "second", "https://b.com/?token=secret2", "", nil)
+	require.NoError(t, err)
+	require.NoError(t, rep.Close(context.TODO()))
+	assertSealed(t)
+
+	_, err = open(t, "")
+	assert.ErrorIs(t, err, snapshot.ErrEncrypted)
+
+	rep, err = open(t, strings.Split(testDumpKeys(2), ",")[1])
+	require.NoError(t, err)
+	for id, want := range map[string]string{
+		"plain":  "https://plain.com",
+		"first":  "https://a.com/?token=secret1",
+		"second": "https://b.com/?token=secret2",
+	} {
+		got, err := rep.Get(context.TODO(), id)
+		assert.NoError(t, err, id)
+		assert.Equal(t, want, got)
+	}
+	_, err = rep.Store(context.TODO(), "third", "https://c.com/?token=secret3", "", nil)
+	require.NoError(t, err)
+	_, err = rep.Store(context.TODO(), "fourth", "https://d.com/?token=secret4", "", nil)
+	require.NoError(t, err)
+	require.NoError(t, rep.Close(context.TODO()))
+
+	// Sealed rows are bound to their place in the dump.
+	var records [][]byte
+	_, err = wal.Replay(path, func(data []byte) error {
+		records = append(records, append([]byte(nil), data...))
+		return nil
+	})
+	require.NoError(t, err)
+	require.Len(t, records, 5, "a segment of the second row and one of the third and fourth")
+	records[3], records[4] = records[4], records[3]
+	require.NoError(t, os.Remove(path))
+	w, err := wal.OpenWriter(path, wal.SyncNever)
+	require.NoError(t, err)
+	for _, record := range records {
+		require.NoError(t, w.Append(record))
+	}
+	require.NoError(t, w.Close())
+
+	_, err = open(t, testDumpKeys(2))
+	assert.ErrorIs(t, err, repository.ErrDumpTampered)
+}
+
+func TestAdminCompact(t *testing.T) {
+	logger, err := zap.NewDevelopment()
+	require.NoError(t, err)
+	sugar := logger.Sugar()
+	repo, err := repository.NewRepository(
+		repository.StorageConfig{MaxStorageSize: 100_000},
+		repository.AddDumpFile(t.TempDir()+"/dump.wal"),
+	)
+	require.NoError(t, err)
+	defer repo.Close(context.TODO())
+	_, err = repo.Store(context.TODO(), "short", "long", "", nil)
+	require.NoError(t, err)
+
+	r := router.NewRouter(new(ShortenerURLServiceMock), sugar, testSecret, router.WithAdmin(repo, "admin-token"))
+	diagnostics := httptest.NewRecorder()
+	r.ServeHTTP(diagnostics, httptest.NewRequest(http.MethodGet, "/api/diagnostics", nil))
+	assert.Equal(t, http.StatusUnauthorized, diagnostics.Code)
+	req := httptest.NewRequest(http.MethodGet, "/api/diagnostics", nil)
+	req.Header.Set("Authorization", "Bearer admin-token")
+	diagnostics = httptest.NewRecorder()
+	r.ServeHTTP(diagnostics, req)
+	assert.Equal(t, http.StatusOK, diagnostics.Code)
+
+	request := func(token string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/api/admin/compact", nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	assert.Equal(t, http.StatusUnauthorized, request("").Code)
+	assert.Equal(t, http.StatusUnauthorized, request("wrong-token").Code)
+
+	w := request("admin-token")
+	require.Equal(t, http.StatusOK, w.Code)
+	var compaction dto.Compaction
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&compaction))
+	assert.Equal(t, 1, compaction.Links)
+}
+
+func TestTrustedClientMiddleware(t *testing.T) {
+	var trusted bool
+	handler := middlewares.NewTrustedClientMiddleware("client-token")(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			trusted = auth.IsTrustedClient(r.Context())
+		}),
+	)
+	for token, want := range map[string]bool{"": false, "wrong-token": false, "client-token": true} {
+		req := httptest.NewRequest(http.MethodPost, "/api/shorten/batch", nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+		assert.Equal(t, want, trusted, token)
+	}
+}
+
+func TestRepository_Close(t *testing.T) {
+	tempDir := os.TempDir()
+	file, err := os.CreateTemp(tempDir, "*.json")
+	assert.NoError(t, err)
+	defer os.Remove(file.Name())
+
+	repo, err := repository.NewRepository(repository.StorageConfig{MaxStorageSize: 100_000}, repository.AddDumpFile(file.Name()))
+	assert.NoError(t, err)
+
+	err = repo.Close(context.TODO())
+	assert.NoError(t, err)
+}
+
+func TestURLShortenerService(t *testing.T) {
+	longValidURL := "https://validurl.com"
+	longValidURL2 := "https://validurl2.com"
+	longNOTValidURL := "NOT valid url.com"
+	repo, err := repository.NewRepository(repository.StorageConfig{MaxStorageSize: 100_000})
+	assert.NoError(t, err)
+
+	ser := service.NewURLShortener(repo, baseAddr)
+
+	t.Run("Shorten valid url", func(t *testing.T) {
+		shortURL, err := ser.ShortenURL(context.TODO(), longValidURL, dto.ShortenOptions{})
+		assert.NoError(t, err)
+		assert.NotEqual(t, shortURL, longValidURL)
+		assert.Contains(t, shortURL, baseAddr)
+	})
+
+	t.Run("Shorten NOT valid url", func(t *testing.T) {
+		_, err := ser.ShortenURL(context.TODO(), longNOTValidURL, dto.ShortenOptions{})
+		assert.Error(t, err)
+	})
+
+	t.Run("Shorten EXISTS valid long url", func(t *testing.T) {
+		_, err := ser.ShortenURL(context.TODO(), longValidURL, dto.ShortenOptions{})
+		assert.ErrorIs(t, service.ErrLongURLAlreadyExists, err)
+	})
+
+	t.Run("Shorten with custom alias", func(t *testing.T) {
+		shortURL, err := ser.ShortenURL(context.TODO(), "https://custom.com", dto.ShortenOptions{Alias: "q4-report"})
+		assert.NoError(t, err)
+		assert.Equal(t, baseAddr+"/q4-report", shortURL)
+
+		_, err = ser.ShortenURL(context.TODO(), "https://custom2.com", dto.ShortenOptions{Alias: "q4-report"})
+		assert.ErrorIs(t, err, service.ErrAliasAlreadyTaken)
+	})
+
+	t.Run("Shorten with invalid alias", func(t *testing.T) {
+		_, err := ser.ShortenURL(context.TODO(), "https://custom3.com", dto.ShortenOptions{Alias: "ping"})
+		assert.ErrorIs(t, err, service.ErrInvalidAlias)
+
+		_, err = ser.ShortenURL(context.TODO(), "https://custom3.com", dto.ShortenOptions{Alias: "no/slashes"})
+		assert.ErrorIs(t, err, service.ErrInvalidAlias)
+	})
+
+	t.Run("Shorten with invalid expiration", func(t *testing.T) {
+		past := time.Now().Add(-time.Hour)
+		_, err := ser.ShortenURL(context.TODO(), "https://expired.com", dto.ShortenOptions{ExpiresAt: &past})
+		assert.ErrorIs(t, err, service.ErrInvalidExpiry)
+
+		_, err = ser.ShortenURL(context.TODO(), "https://expired.com", dto.ShortenOptions{TTLSeconds: -1})
+		assert.ErrorIs(t, err, service.ErrInvalidExpiry)
+	})
+
+	t.Run("Store batch with duplicates", func(t *testing.T) {
+		result, err := ser.StoreBatchURL(context.TODO(), []dto.OriginalURL{
+			{ID: "batch-1", URL: "https://batch1.com"},
+			{ID: "batch-2", URL: longValidURL},
+			{ID: "batch-3", URL: "https://batch1.com"},
+		}, dto.BatchOptions{})
+		assert.NoError(t, err)
+		require.Len(t, result, 3)
+
+		assert.Equal(t, "batch-1", result[0].ID)
+		assert.Equal(t, dto.StatusCreated, result[0].Status)
+		assert.NotEqual(t, baseAddr+"/batch-1", result[0].URL)
+		assert.Equal(t, dto.StatusExisting, result[1].Status)
+		assert.Equal(t, dto.ShortedURL{ID: "batch-3", URL: result[0].URL, Status: dto.StatusExisting}, result[2])
+	})
+
+	t.Run("Store batch with invalid items", func(t *testing.T) {
+		result, err := ser.StoreBatchURL(auth.WithTrustedClient(context.TODO()), []dto.OriginalURL{
+			{ID: "partial-1", URL: "https://partial1.com", Alias: "partial-1"},
+			{ID: "partial-2", URL: "not-a-url"},
+			{ID: "partial-3", URL: "https://partial3.com", Alias: "partial-1"},
+			{ID: "partial-4", URL: "https://partial4.com", Alias: "api"},
+		}, dto.BatchOptions{})
+		assert.NoError(t, err)
+		require.Len(t, result, 4)
+
+		assert.Equal(t, dto.ShortedURL{ID: "partial-1", URL: baseAddr + "/partial-1", Status: dto.StatusCreated}, result[0])
+		assert.Equal(t, dto.StatusInvalid, result[1].Status)
+		assert.NotEmpty(t, result[1].Error)
+		assert.Equal(t, dto.StatusInvalid, result[2].Status)
+		assert.Equal(t, service.ErrAliasAlreadyTaken.Error(), result[2].Error)
+		assert.Equal(t, dto.StatusInvalid, result[3].Status)
+	})
+
+	t.Run("Store batch atomically", func(t *testing.T) {
+		trusted := auth.WithTrustedClient(context.TODO())
+		_, err := ser.StoreBatchURL(trusted, []dto.OriginalURL{
+			{ID: "atomic-1", URL: "https://atomic1.com", Alias: "atomic-1"},
+			{ID: "atomic-2", URL: "not-a-url"},
+		}, dto.BatchOptions{Atomic: true})
+		assert.Error(t, err)
+
+		_, err = ser.StoreBatchURL(trusted, []dto.OriginalURL{
+			{ID: "atomic-1", URL: "https://atomic1.com", Alias: "atomic-1"},
+			{ID: "atomic-2", URL: "https://atomic2.com", Alias: "partial-1"},
+		}, dto.BatchOptions{Atomic: true})
+		assert.ErrorIs(t, err, service.ErrAliasAlreadyTaken)
+
+		_, err = ser.FindByShortened(context.TODO(), "atomic-1")
+		assert.ErrorIs(t, err, service.ErrNotFound)
+	})
+
+	t.Run("Find by user", func(t *testing.T) {
+		ctx := auth.WithUserID(context.TODO(), "owner")
+		shortURL, err := ser.ShortenURL(ctx, "https://owned.com", dto.ShortenOptions{})
+		assert.NoError(t, err)
+
+		urls, err := ser.FindByUser(ctx)
+		assert.NoError(t, err)
+		assert.Equal(t, []dto.UserURL{{ShortURL: shortURL, OriginalURL: "https://owned.com"}}, urls)
+
+		_, err = ser.FindByUser(context.TODO())
+		assert.ErrorIs(t, err, service.ErrUnauthorized)
+	})
+
+	t.Run("Find by Alias(Shortened)", func(t *testing.T) {
+		shortURL, err := ser.ShortenURL(context.TODO(), longValidURL2, dto.ShortenOptions{})
+		assert.NoError(t, err)
+		id := (strings.Split(shortURL, baseAddr+"/"))[1]
+		res, err := ser.FindByShortened(context.TODO(), id)
+		assert.NoError(t, err)
+		assert.Equal(t, longValidURL2, res)
+	})
+}
+
+func TestAuthMiddleware(t *testing.T) {
+	logger, err := zap.NewDevelopment()
+	require.NoError(t, err)
+
+	var gotUserID string
+	handler := middlewares.NewAuthMiddleware(testSecret, logger.Sugar())(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			gotUserID, _ = auth.UserIDFromContext(r.Context())
+		}),
+	)
+
+	t.Run("issues cookie for new user", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+
+		cookies := w.Result().Cookies()
+		require.Len(t, cookies, 1)
+		userID, ok := auth.Verify(cookies[0].Value, []byte(testSecret))
+		assert.True(t, ok)
+		assert.Equal(t, userID, gotUserID)
+	})
+
+	t.Run("accepts signed cookie", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.AddCookie(&http.Cookie{Name: "user_id", Value: auth.Sign("known-user", []byte(testSecret))})
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+
+		assert.Empty(t, w.Result().Cookies())
+		assert.Equal(t, "known-user", gotUserID)
+	})
+
+	t.Run("replaces forged cookie", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.AddCookie(&http.Cookie{Name: "user_id", Value: auth.Sign("known-user", []byte("other-secret"))})
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+
+		assert.Len(t, w.Result().Cookies(), 1)
+		assert.NotEqual(t, "known-user", gotUserID)
+	})
+}
+
+func TestURLShortenerService_DeleteUserURLs(t *testing.T) {
+	repo, err := repository.NewRepository(repository.StorageConfig{MaxStorageSize: 100_000})
+	assert.NoError(t, err)
+	ser := service.NewURLShortener(repo, baseAddr)
+
+	owner := auth.WithUserID(context.TODO(), "owner")
+	stranger := auth.WithUserID(context.TODO(), "stranger")
+
+	ownedURL, err := ser.ShortenURL(owner, "https://owned.com", dto.ShortenOptions{})
+	assert.NoError(t, err)
+	ownedID := (strings.Split(ownedURL, baseAddr+"/"))[1]
+	foreignURL, err := ser.ShortenURL(stranger, "https://foreign.com", dto.ShortenOptions{})
+	assert.NoError(t, err)
+	foreignID := (strings.Split(foreignURL, baseAddr+"/"))[1]
+
+	err = ser.DeleteUserURLs(context.TODO(), []string{ownedID})
+	assert.ErrorIs(t, err, service.ErrUnauthorized)
+
+	err = ser.DeleteUserURLs(owner, []string{ownedID, foreignID})
+	assert.NoError(t, err)
+	ser.Close()
+
+	_, err = ser.FindByShortened(context.TODO(), ownedID)
+	assert.ErrorIs(t, err, service.ErrURLDeleted)
+
+	res, err := ser.FindByShortened(context.TODO(), foreignID)
+	assert.NoError(t, err)
+	assert.Equal(t, "https://foreign.com", res)
+}
+
+func TestClientIPAnonymize(t *testing.T) {
+	assert.Equal(t, "203.0.113.0", clientip.Anonymize("203.0.113.42"))
+	assert.Equal(t, "2001:db8:abcd::", clientip.Anonymize("2001:db8:abcd:12::1"))
+	assert.Equal(t, "", clientip.Anonymize("not-an-ip"))
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("X-Forwarded-For", "198.51.100.7, 10.0.0.1")
+	assert.Equal(t, "192.0.2.1", clientip.FromRequest(req), "unresolved requests use the peer")
+
+	untrusting, err := clientip.NewResolver()
+	require.NoError(t, err)
+	assert.Equal(t, "192.0.2.1", untrusting.Resolve(req), "headers of untrusted peers are ignored")
+
+	resolver, err := clientip.NewResolver("192.0.2.1", "10.0.0.0/8")
+	require.NoError(t, err)
+	assert.Equal(t, "198.51.100.7", resolver.Resolve(req), "trusted hops are skipped")
+	assert.Equal(t, "198.51.100.7", clientip.FromRequest(req.WithContext(clientip.WithAddr(req.Context(), resolver.Resolve(req)))))
+
+	req.Header.Set("X-Forwarded-For", "198.51.100.7, 203.0.113.9, 10.0.0.1")
+	assert.Equal(t, "203.0.113.9", resolver.Resolve(req), "hops before an untrusted one may be forged")
+
+	req.Header.Del("X-Forwarded-For")
+	req.Header.Set("X-Real-IP", "198.51.100.8")
+	assert.Equal(t, "198.51.100.8", resolver.Resolve(req))
+
+	_, err = clientip.NewResolver("not-a-proxy")
+	assert.Error(t, err)
+}
+
+func TestURLShortenerService_Stats(t *testing.T) {
+	repo, err := repository.NewRepository(repository.StorageConfig{MaxStorageSize: 100_000})
+	assert.NoError(t, err)
+	ser := service.NewURLShortener(repo, baseAddr)
+
+	owner := auth.WithUserID(context.TODO(), "owner")
+	_, err = ser.ShortenURL(owner, "https://stats.com", dto.ShortenOptions{Alias: "stats-link"})
+	assert.NoError(t, err)
+
+	day := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	clicks := []dto.Click{
+		{Alias: "stats-link", ClickedAt: day, Referrer: "https://a.com", UserAgent: "curl", IP: "10.0.0.0"},
+		{Alias: "stats-link", ClickedAt: day.Add(time.Hour), Referrer: "https://a.com", UserAgent: "firefox", IP: "10.0.0.0"},
+		{Alias: "stats-link", ClickedAt: day.Add(24 * time.Hour), UserAgent: "curl", IP: "10.0.1.0"},
+		{Alias: "other-link", ClickedAt: day, IP: "10.0.2.0"},
+	}
+	for _, click := range clicks {
+		ser.RecordClick(click)
+	}
+	ser.Close()
+
+	stats, err := ser.Stats(owner, "stats-link", day.Add(-time.Hour), day.Add(48*time.Hour))
+	assert.NoError(t, err)
+	assert.Equal(t, int64(3), stats.TotalClicks)
+	assert.Equal(t, int64(2), stats.UniqueVisitors)
+	assert.Equal(t, []dto.DailyClicks{{Date: "2026-03-01", Clicks: 2}, {Date: "2026-03-02", Clicks: 1}}, stats.ClicksPerDay)
+	assert.Equal(t, []dto.CountedValue{{Value: "https://a.com", Count: 2}}, stats.TopReferrers)
+	assert.Equal(t, []dto.CountedValue{{Value: "curl", Count: 2}, {Value: "firefox", Count: 1}}, stats.TopUserAgents)
+
+	_, err = ser.Stats(auth.WithUserID(context.TODO(), "stranger"), "stats-link", time.Time{}, time.Time{})
+	assert.ErrorIs(t, err, service.ErrForbidden)
+
+	_, err = ser.Stats(owner, "missing-link", time.Time{}, time.Time{})
+	assert.ErrorIs(t, err, service.ErrNotFound)
+}
+
+func TestAliasGenerators(t *testing.T) {
+	for _, strategy := range []string{service.StrategyRandom, service.StrategyBase62, service.StrategyCounter, service.StrategyHash} {
+		t.Run(strategy, func(t *testing.T) {
+			gen, err := service.NewAliasGenerator(strategy, 6)
+			require.NoError(t, err)
+
+			seen := make(map[string]struct{})
+			for i := 0; i < 100; i++ {
+				alias := gen.Generate(fmt.Sprintf("https://example.com/%d", i), 0)
+				assert.Len(t, alias, 6)
+				assert.True(t, validator.IsValidAlias(alias))
+				seen[alias] = struct{}{}
+			}
+			assert.Greater(t, len(seen), 95)
+		})
+	}
+
+	t.Run("hash is deterministic", func(t *testing.T) {
+		gen, err := service.NewAliasGenerator(service.StrategyHash, 8)
+		require.NoError(t, err)
+		assert.Equal(t, gen.Generate("https://example.com", 0), gen.Generate("https://example.com", 0))
+		assert.NotEqual(t, gen.Generate("https://example.com", 0), gen.Generate("https://example.com", 1))
+	})
+
+	t.Run("counter does not repeat", func(t *testing.T) {
+		gen, err := service.NewAliasGenerator(service.StrategyCounter, 2)
+		require.NoError(t, err)
+		seen := make(map[string]struct{})
+		for i := 0; i < 62*62; i++ {
+			seen[gen.Generate("", 0)] = struct{}{}
+		}
+		assert.Len(t, seen, 62*62)
+	})
+
+	t.Run("unknown strategy", func(t *testing.T) {
+		_, err := service.NewAliasGenerator("uuid", 8)
+		assert.Error(t, err)
+	})
+}
+
+type constGenerator struct {
+	length int
+}
+
+func (g constGenerator) Generate(string, int) string {
+	return strings.Repeat("a", g.length)
+}
+
+func (g constGenerator) Length() int {
+	return g.length
+}
+
+func (g constGenerator) WithLength(length int) (service.AliasGenerator, error) {
+	return constGenerator{length: length}, nil
+}
+
+func TestURLShortenerService_AdaptiveAliasLength(t *testing.T) {
+	repo, err := repository.NewRepository(repository.StorageConfig{MaxStorageSize: 100_000})
+	require.NoError(t, err)
+	ser := service.NewURLShortener(repo, baseAddr, service.WithAliasGenerator(constGenerator{length: 3}))
+	defer ser.Close()
+
+	// A generator of constant aliases collides on every retry once its
+	// alias is taken, so the length has to grow to keep shortening working.
+	succeeded := 0
+	for i := 0; i < 20; i++ {
+		_, err := ser.ShortenURL(context.TODO(), fmt.Sprintf("https://crowded.com/%d", i), dto.ShortenOptions{})
+		if err == nil {
+			succeeded++
+		}
+	}
+
+	diag := ser.Diagnostics(context.TODO())
+	assert.Equal(t, 10, succeeded)
+	assert.Equal(t, 13, diag.Aliases.Length)
+	assert.Equal(t, uint64(10), diag.Aliases.Resizes)
+	assert.Equal(t, uint64(30), diag.Aliases.Collisions)
+
+	// Shortening a URL again is not a collision, even when the alias
+	// generated for it is the one it is stored under.
+	hashed, err := service.NewAliasGenerator(service.StrategyHash, 6)
+	require.NoError(t, err)
+	ser = service.NewURLShortener(repo, baseAddr, service.WithAliasGenerator(hashed))
+	defer ser.Close()
+	for i := 0; i < 50; i++ {
+		_, err := ser.ShortenURL(context.TODO(), "https://again.com", dto.ShortenOptions{})
+		if i > 0 {
+			assert.ErrorIs(t, err, service.ErrLongURLAlreadyExists)
+		}
+	}
+	diag = ser.Diagnostics(context.TODO())
+	assert.Equal(t, 6, diag.Aliases.Length)
+	assert.Zero(t, diag.Aliases.Collisions)
+}
+
+func TestURLShortenerService_BatchAliasRetries(t *testing.T) {
+	repo, err := repository.NewRepository(repository.StorageConfig{MaxStorageSize: 100_000})
+	require.NoError(t, err)
+	ser := service.NewURLShortener(repo, baseAddr, service.WithAliasGenerator(constGenerator{length: 3}))
+	defer ser.Close()
+
+	result, err := ser.StoreBatchURL(context.TODO(), []dto.OriginalURL{
+		{ID: "1", URL: "https://retry1.com"},
+		{ID: "2", URL: "https://retry2.com"},
+	}, dto.BatchOptions{})
+	require.NoError(t, err)
+	require.Len(t, result, 2)
+	assert.Equal(t, dto.ShortedURL{ID: "1", URL: baseAddr + "/aaa", Status: dto.StatusCreated}, result[0])
+	assert.Equal(t, dto.StatusInvalid, result[1].Status)
+
+	// The exhausted retries have grown the alias length.
+	result, err = ser.StoreBatchURL(context.TODO(), []dto.OriginalURL{
+		{ID: "2", URL: "https://retry2.com"},
+	}, dto.BatchOptions{Atomic: true})
+	require.NoError(t, err)
+	assert.Equal(t, []dto.ShortedURL{{ID: "2", URL: baseAddr + "/aaaa", Status: dto.StatusCreated}}, result)
+}
+
+type countingGenerator struct {
+	constGenerator
+	calls *atomic.Int32
+}
+
+func (g countingGenerator) Generate(longURL string, attempt int) string {
+	g.calls.Add(1)
+	return g.constGenerator.Generate(longURL, attempt)
+}
+
+func TestURLShortenerService_BatchRequestedAliases(t *testing.T) {
+	repo, err := repository.NewRepository(repository.StorageConfig{MaxStorageSize: 100_000})
+	require.NoError(t, err)
+	var calls atomic.Int32
+	ser := service.NewURLShortener(repo, baseAddr, service.WithAliasGenerator(countingGenerator{constGenerator{length: 8}, &calls}))
+	defer ser.Close()
+	trusted := auth.WithTrustedClient(context.TODO())
+
+	result, err := ser.StoreBatchURL(context.TODO(), []dto.OriginalURL{
+		{ID: "1", URL: "https://requested1.com", Alias: "mine"},
+	}, dto.BatchOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, dto.StatusInvalid, result[0].Status)
+	assert.Contains(t, result[0].Error, service.ErrAliasNotAllowed.Error())
+
+	_, err = ser.StoreBatchURL(context.TODO(), []dto.OriginalURL{
+		{ID: "1", URL: "https://requested1.com", Alias: "mine"},
+	}, dto.BatchOptions{Atomic: true})
+	assert.ErrorIs(t, err, service.ErrAliasNotAllowed)
+
+	result, err = ser.StoreBatchURL(trusted, []dto.OriginalURL{
+		{ID: "1", URL: "https://requested1.com", Alias: "mine"},
+	}, dto.BatchOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, dto.ShortedURL{ID: "1", URL: baseAddr + "/mine", Status: dto.StatusCreated}, result[0])
+
+	// A requested alias that is taken rejects an atomic batch without
+	// spending retries on the generated ones.
+	calls.Store(0)
+	_, err = ser.StoreBatchURL(trusted, []dto.OriginalURL{
+		{ID: "1", URL: "https://requested2.com"},
+		{ID: "2", URL: "https://requested3.com", Alias: "mine"},
+	}, dto.BatchOptions{Atomic: true})
+	assert.ErrorIs(t, err, service.ErrAliasAlreadyTaken)
+	assert.Equal(t, int32(1), calls.Load())
+}
+
+func TestMetricsExposition(t *testing.T) {
+	counter := metrics.NewCounterVec("test_events_total", "Test events.", "kind")
+	counter.Inc("a")
+	counter.Add(2, `quoted "b"`)
+	histogram := metrics.NewHistogramVec("test_latency_seconds", "Test latency.", []float64{0.1, 1})
+	histogram.Observe(0.5)
+	metrics.SetGaugeFunc("test_gauge", "Test gauge.", func() float64 { return 42 })
+
+	w := httptest.NewRecorder()
+	metrics.Handler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	body := w.Body.String()
+
+	assert.Contains(t, body, "# TYPE test_events_total counter\n")
+	assert.Contains(t, body, `test_events_total{kind="a"} 1`+"\n")
+	assert.Contains(t, body, `test_events_total{kind="quoted \"b\""} 2`+"\n")
+	assert.Contains(t, body, `test_latency_seconds_bucket{le="0.1"} 0`+"\n")
+	assert.Contains(t, body, `test_latency_seconds_bucket{le="1"} 1`+"\n")
+	assert.Contains(t, body, `test_latency_seconds_bucket{le="+Inf"} 1`+"\n")
+	assert.Contains(t, body, "test_latency_seconds_count 1\n")
+	assert.Contains(t, body, "test_gauge 42\n")
+}
+
+func TestRateLimitMiddleware(t *testing.T) {
+	limiter := middlewares.NewRateLimiter(1, 2)
+	handler := middlewares.NewRateLimitMiddleware(limiter)(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}),
+	)
+
+	request := func(ctx context.Context, remoteAddr string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/", nil).WithContext(ctx)
+		req.RemoteAddr = remoteAddr
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w
+	}
+
+	for i := 0; i < 2; i++ {
+		w := request(context.TODO(), "192.0.2.1:1234")
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, "2", w.Header().Get("X-RateLimit-Limit"))
+		assert.Equal(t, strconv.Itoa(1-i), w.Header().Get("X-RateLimit-Remaining"))
+		assert.Equal(t, strconv.Itoa(i+1), w.Header().Get("X-RateLimit-Reset"), "reset is sent on every response")
+	}
+
+	w := request(context.TODO(), "192.0.2.1:1234")
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.Equal(t, "1", w.Header().Get("Retry-After"))
+	assert.Equal(t, "2", w.Header().Get("X-RateLimit-Reset"))
+
+	req := httptest.NewRequest(http.MethodPost, "/", nil)
+	req.RemoteAddr = "192.0.2.1:1234"
+	req.Header.Set("X-Forwarded-For", "198.51.100.7")
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusTooManyRequests, w.Code, "forwarding headers of untrusted peers do not change the key")
+
+	w = request(context.TODO(), "192.0.2.2:1234")
+	assert.Equal(t, http.StatusOK, w.Code, "other ip has its own bucket")
+
+	w = request(auth.WithUserID(context.TODO(), "user"), "192.0.2.1:1234")
+	assert.Equal(t, http.StatusOK, w.Code, "authenticated user is keyed by id")
+
+	w = request(auth.WithIssuedUserID(context.TODO(), "fresh-user"), "192.0.2.1:1234")
+	assert.Equal(t, http.StatusTooManyRequests, w.Code, "anonymous user is keyed by ip")
+}
+
+func TestAuthMiddleware_IssueLimit(t *testing.T) {
+	logger, err := zap.NewDevelopment()
+	require.NoError(t, err)
+	handler := middlewares.NewAuthMiddleware(testSecret, logger.Sugar(), middlewares.WithIssueLimiter(middlewares.NewRateLimiter(1, 2)))(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}),
+	)
+
+	request := func(cookie *http.Cookie) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/", nil)
+		if cookie != nil {
+			req.AddCookie(cookie)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w
+	}
+
+	var cookie *http.Cookie
+	for i := 0; i < 2; i++ {
+		w := request(nil)
+		require.Equal(t, http.StatusOK, w.Code)
+		cookie = w.Result().Cookies()[0]
+	}
+	w := request(nil)
+	assert.Equal(t, http.StatusTooManyRequests, w.Code, "cookies cannot be rotated to get fresh buckets")
+	assert.Empty(t, w.Result().Cookies())
+
+	w = request(cookie)
+	assert.Equal(t, http.StatusOK, w.Code, "clients keeping their cookie are not limited")
+}
+
+func TestRouter_IssueLimit(t *testing.T) {
+	logger, err := zap.NewDevelopment()
+	require.NoError(t, err)
+	serviceMock := new(ShortenerURLServiceMock)
+	serviceMock.On("FindByShortened", "abc").Return("https://example.com", nil)
+	serviceMock.On("ShortenURL", "https://example.com", mock.Anything).Return("http://localhost/abc", nil)
+	r := router.NewRouter(
+		serviceMock, logger.Sugar(), testSecret,
+		router.WithIssueRateLimit(1, 2),
+		router.WithRedirectRateLimit(100, 200),
+	)
+
+	request := func(method, target, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		req.RemoteAddr = "192.0.2.1:1234"
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	for i := 0; i < 30; i++ {
+		w := request(http.MethodGet, "/abc", "")
+		require.Equal(t, http.StatusTemporaryRedirect, w.Code, "redirect %d", i)
+	}
+	for i := 0; i < 2; i++ {
+		w := request(http.MethodPost, "/", "https://example.com")
+		require.Equal(t, http.StatusCreated, w.Code)
+	}
+	w := request(http.MethodPost, "/", "https://example.com")
+	assert.Equal(t, http.StatusTooManyRequests, w.Code, "shortening without a cookie is limited")
+}
+
+func TestIdempotencyMiddleware(t *testing.T) {
+	logger, err := zap.NewDevelopment()
+	require.NoError(t, err)
+	repo, err := repository.NewRepository(repository.StorageConfig{MaxStorageSize: 100_000})
+	require.NoError(t, err)
+
+	calls := 0
+	handler := middlewares.NewIdempotencyMiddleware(repo, time.Hour, logger.Sugar())(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			calls++
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusCreated)
+			fmt.Fprintf(w, `{"call":%d}`, calls)
+		}),
+	)
+
+	request := func(key, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/api/shorten", strings.NewReader(body))
+		if key != "" {
+			req.Header.Set("Idempotency-Key", key)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w
+	}
+
+	w := request("key-1", `{"url":"https://a.com"}`)
+	assert.Equal(t, http.StatusCreated, w.Code)
+	assert.Equal(t, `{"call":1}`, w.Body.String())
+
+	w = request("key-1", `{"url":"https://a.com"}`)
+	assert.Equal(t, http.StatusCreated, w.Code)
+	assert.Equal(t, `{"call":1}`, w.Body.String(), "repeat is replayed")
+	assert.Equal(t, "application/json", w.Header().Get("Content-Type"))
+	assert.Equal(t, 1, calls)
+
+	w = request("key-1", `{"url":"https://b.com"}`)
+	assert.Equal(t, http.StatusUnprocessableEntity, w.Code)
+
+	w = request("key-2", `{"url":"https://a.com"}`)
+	assert.Equal(t, `{"call":2}`, w.Body.String())
+
+	w = request("", `{"url":"https://a.com"}`)
+	assert.Equal(t, `{"call":3}`, w.Body.String(), "requests without a key are not remembered")
+
+	t.Run("concurrent repeat", func(t *testing.T) {
+		started, release := make(chan struct{}), make(chan struct{})
+		var handled atomic.Int32
+		handler := middlewares.NewIdempotencyMiddleware(repo, time.Hour, logger.Sugar())(
+			http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if handled.Add(1) == 1 {
+					close(started)
+					<-release
+				}
+				w.WriteHeader(http.StatusCreated)
+			}),
+		)
+		request := func() *httptest.ResponseRecorder {
+			req := httptest.NewRequest(http.MethodPost, "/api/shorten", strings.NewReader(`{}`))
+			req.Header.Set("Idempotency-Key", "concurrent")
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, req)
+			return w
+		}
+
+		first := make(chan *httptest.ResponseRecorder)
+		go func() { first <- request() }()
+		<-started
+		w := request()
+		assert.Equal(t, http.StatusConflict, w.Code, "a repeat in flight is not handled twice")
+		close(release)
+		assert.Equal(t, http.StatusCreated, (<-first).Code)
+
+		w = request()
+		assert.Equal(t, http.StatusCreated, w.Code)
+		assert.Equal(t, "true", w.Header().Get("Idempotent-Replayed"))
+		assert.Equal(t, int32(1), handled.Load())
+	})
+
+	t.Run("server error releases the key", func(t *testing.T) {
+		var handled atomic.Int32
+		handler := middlewares.NewIdempotencyMiddleware(repo, time.Hour, logger.Sugar())(
+			http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if handled.Add(1) == 1 {
+					w.WriteHeader(http.StatusInternalServerError)
+					return
+				}
+				w.WriteHeader(http.StatusCreated)
+			}),
+		)
+		for _, want := range []int{http.StatusInternalServerError, http.StatusCreated} {
+			req := httptest.NewRequest(http.MethodPost, "/api/shorten", strings.NewReader(`{}`))
+			req.Header.Set("Idempotency-Key", "failing")
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, req)
+			assert.Equal(t, want, w.Code)
+		}
+	})
+}
+
+// mutexStorage is the in-memory storage as it was before sharding: every
+// index behind a single RWMutex. It is kept as a baseline for
+// BenchmarkMemoryStorage.
+type mutexStorage struct {
+	m                     sync.RWMutex
+	storage               map[string]mutexRecord
+	uniqueValueConstraint map[string]string
+	userIndex             map[string][]string
+}
+
+type mutexRecord struct {
+	value     string
+	userID    string
+	deleted   bool
+	expiresAt time.Time
+}
+
+func newMutexStorage() *mutexStorage {
+	return &mutexStorage{
+		storage:               make(map[string]mutexRecord),
+		uniqueValueConstraint: make(map[string]string),
+		userIndex:             make(map[string][]string),
+	}
+}
+
+func (s *mutexStorage) Store(ctx context.Context, id, value, userID string, expiresAt *time.Time) (string, error) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	if alias, ok := s.uniqueValueConstraint[value]; ok {
+		return alias, storage.ErrUniqueViolation
+	}
+	if _, ok := s.storage[id]; ok {
+		return "", storage.ErrNotUniqueID
+	}
+	r := mutexRecord{value: value, userID: userID}
+	if expiresAt != nil {
+		r.expiresAt = *expiresAt
+	}
+	s.storage[id] = r
+	s.uniqueValueConstraint[value] = id
+	if userID != "" {
+		s.userIndex[userID] = append(s.userIndex[userID], id)
+	}
+	return id, nil
+}
+
+func (s *mutexStorage) Get(ctx context.Context, id string) (storage.Link, error) {
+	s.m.RLock()
+	defer s.m.RUnlock()
+	r, ok := s.storage[id]
+	if !ok {
+		return storage.Link{}, storage.ErrNotFound
+	}
+	if r.deleted {
+		return storage.Link{}, storage.ErrDeleted
+	}
+	if !r.expiresAt.IsZero() && !r.expiresAt.After(time.Now()) {
+		return storage.Link{}, storage.ErrExpired
+	}
+	return storage.Link{Value: r.value}, nil
+}
+
+// BenchmarkMemoryStorage measures throughput of mixed redirects and writes
+// against the sharded storage and, as a baseline, the storage guarded by a
+// single mutex. A single shard measures what sharding adds on one lock.
+func BenchmarkMemoryStorage(b *testing.B) {
+	const preloaded = 10_000
+
+	type linkStore interface {
+		Store(ctx context.Context, id, value, userID string, expiresAt *time.Time) (string, error)
+		Get(ctx context.Context, id string) (storage.Link, error)
+	}
+	stores := []struct {
+		name string
+		new  func() linkStore
+	}{
+		{"mutex", func() linkStore { return newMutexStorage() }},
+		{"shards=1", func() linkStore { return memorystorage.NewMemoryStorage(0, memorystorage.WithShards(1)) }},
+		{"shards=32", func() linkStore { return memorystorage.NewMemoryStorage(0, memorystorage.WithShards(32)) }},
+	}
+
+	for _, store := range stores {
+		for _, writePercent := range []int64{1, 10, 50} {
+			name := fmt.Sprintf("%s/writes=%d%%", store.name, writePercent)
+			b.Run(name, func(b *testing.B) {
+				s := store.new()
+				keys := make([]string, preloaded)
+				for i := range keys {
+					keys[i] = fmt.Sprintf("k%d", i)
+					_, err := s.Store(context.TODO(), keys[i], "https://preloaded.com/"+keys[i], "", nil)
+					require.NoError(b, err)
+				}
+
+				var seq atomic.Int64
+				b.ResetTimer()
+				b.RunParallel(func(pb *testing.PB) {
+					for pb.Next() {
+						n := seq.Add(1)
+						if n%100 < writePercent {
+							s.Store(context.TODO(), fmt.Sprintf("w%d", n), fmt.Sprintf("https://written.com/%d", n), "", nil)
+						} else {
+							s.Get(context.TODO(), keys[n%preloaded])
+						}
+					}
+				})
+			})
+		}
+	}
+}
@@ -4,6 +4,7 @@ go 1.22.10
 
 require (
 	github.com/go-chi/chi/v5 v5.2.0
+	github.com/klauspost/compress v1.18.0
 	github.com/stretchr/testify v1.10.0
 	go.uber.org/zap v1.27.0
 )
@@ -5,28 +5,115 @@ import (
 	"log"
 	"net/http"
 	"os/signal"
+	"sync"
 	"syscall"
 	"time"
+
+	"github.com/DeneesK/short-url/internal/app/dto"
 )
 
 const shutdownTimeout = time.Second * 1
 
 type Logger interface {
 	Infoln(args ...interface{})
+	Errorf(template string, args ...interface{})
 	Fatalf(format string, v ...any)
 }
 
+// Purger removes expired links from the storage.
+type Purger interface {
+	PurgeExpired(ctx context.Context) (int, error)
+}
+
+// Compactor compacts the dump file.
+type Compactor interface {
+	Compact(ctx context.Context) (dto.Compaction, error)
+}
+
+// ChangeListener follows changes made by other instances until ctx is done.
+type ChangeListener interface {
+	ListenForChanges(ctx context.Context)
+}
+
 type APP struct {
-	srv *http.Server
-	log Logger
+	srv     *http.Server
+	log     Logger
+	workers []func(ctx context.Context)
 }
 
-func NewApp(addr string, handler http.Handler, log Logger) *APP {
+type Option func(*APP)
+
+func NewApp(addr string, handler http.Handler, log Logger, opts ...Option) *APP {
 	s := http.Server{
 		Addr:    addr,
 		Handler: handler,
 	}
-	return &APP{srv: &s, log: log}
+	a := &APP{srv: &s, log: log}
+	for _, opt := range opts {
+		opt(a)
+	}
+	return a
+}
+
+// WithReaper runs purger every interval while the app is running.
+func WithReaper(purger Purger, interval time.Duration) Option {
+	return func(a *APP) {
+		if interval <= 0 {
+			return
+		}
+		a.workers = append(a.workers, func(ctx context.Context) {
+			ticker := time.NewTicker(interval)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case <-ticker.C:
+					n, err := purger.PurgeExpired(ctx)
+					if err != nil {
+						a.log.Errorf("failed to purge expired urls: %s", err)
+						continue
+					}
+					if n > 0 {
+						a.log.Infoln("purged expired urls:", n)
+					}
+				}
+			}
+		})
+	}
+}
+
+// WithCompactor runs compactor every interval while the app is running.
+func WithCompactor(compactor Compactor, interval time.Duration) Option {
+	return func(a *APP) {
+		if interval <= 0 {
+			return
+		}
+		a.workers = append(a.workers, func(ctx context.Context) {
+			ticker := time.NewTicker(interval)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case <-ticker.C:
+					c, err := compactor.Compact(ctx)
+					if err != nil {
+						a.log.Errorf("failed to compact dump file: %s", err)
+						continue
+					}
+					a.log.Infoln("compacted dump file, links:", c.Links, "snapshot bytes:", c.SnapshotBytes)
+				}
+			}
+		})
+	}
+}
+
+// WithChangeListener runs listener while the app is running.
+func WithChangeListener(listener ChangeListener) Option {
+	return func(a *APP) {
+		a.workers = append(a.workers, listener.ListenForChanges)
+	}
 }
 
 func (a *APP) Run() {
@@ -47,6 +134,15 @@ func (a *APP) Run() {
 		}
 	}()
 
+	var wg sync.WaitGroup
+	for _, worker := range a.workers {
+		wg.Add(1)
+		go func(worker func(ctx context.Context)) {
+			defer wg.Done()
+			worker(ctx)
+		}(worker)
+	}
+
 	<-ctx.Done()
 
 	a.log.Infoln("application shutdown process...")
@@ -55,6 +151,7 @@ func (a *APP) Run() {
 	if err := a.srv.Shutdown(shutdownCtx); err != nil {
 		log.Fatalf("Error during shutdown: %s", err)
 	}
+	wg.Wait()
 	<-shutdownCtx.Done()
 	a.log.Infoln("application and server gracefully stopped")
 }
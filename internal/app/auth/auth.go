@@ -0,0 +1,91 @@
+package auth
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+)
+
+const userIDLength = 16
+
+type ctxKey struct{}
+
+type trustedKey struct{}
+
+type identity struct {
+	userID        string
+	authenticated bool
+}
+
+// WithUserID stores the ID of a user who presented a valid token.
+func WithUserID(ctx context.Context, userID string) context.Context {
+	return context.WithValue(ctx, ctxKey{}, identity{userID: userID, authenticated: true})
+}
+
+// WithIssuedUserID stores the ID that has just been issued to an
+// anonymous client.
+func WithIssuedUserID(ctx context.Context, userID string) context.Context {
+	return context.WithValue(ctx, ctxKey{}, identity{userID: userID})
+}
+
+func UserIDFromContext(ctx context.Context) (string, bool) {
+	id, ok := ctx.Value(ctxKey{}).(identity)
+	return id.userID, ok && id.userID != ""
+}
+
+// IsAuthenticated reports whether the request carried a valid token
+// rather than getting a new one.
+func IsAuthenticated(ctx context.Context) bool {
+	id, ok := ctx.Value(ctxKey{}).(identity)
+	return ok && id.authenticated
+}
+
+// WithTrustedClient marks the request as coming from a trusted client,
+// which may ask for specific aliases in batches.
+func WithTrustedClient(ctx context.Context) context.Context {
+	return context.WithValue(ctx, trustedKey{}, true)
+}
+
+// IsTrustedClient reports whether the request comes from a trusted client.
+func IsTrustedClient(ctx context.Context) bool {
+	trusted, _ := ctx.Value(trustedKey{}).(bool)
+	return trusted
+}
+
+func NewUserID() (string, error) {
+	b := make([]byte, userIDLength)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// Sign returns token in form "<userID>.<hex(hmac-sha256(userID))>".
+func Sign(userID string, secret []byte) string {
+	return userID + "." + hex.EncodeToString(signature(userID, secret))
+}
+
+// Verify checks token's signature and returns the user ID it carries.
+func Verify(token string, secret []byte) (string, bool) {
+	userID, sig, ok := strings.Cut(token, ".")
+	if !ok || userID == "" {
+		return "", false
+	}
+	decoded, err := hex.DecodeString(sig)
+	if err != nil {
+		return "", false
+	}
+	if !hmac.Equal(decoded, signature(userID, secret)) {
+		return "", false
+	}
+	return userID, true
+}
+
+func signature(userID string, secret []byte) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(userID))
+	return mac.Sum(nil)
+}
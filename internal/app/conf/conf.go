@@ -1,10 +1,13 @@
 package conf
 
 import (
+	"crypto/rand"
+	"encoding/hex"
 	"flag"
 	"log"
 	"os"
 	"strconv"
+	"time"
 )
 
 const gbyte = 1_000_000_000
@@ -14,9 +17,37 @@ type ServerConf struct {
 	BaseURL               string
 	Env                   string
 	FileStoragePath       string
+	DumpSync              string
+	SnapshotCompression   string
+	DumpKeyFile           string
+	DumpKeys              string
 	DBDSN                 string
 	MigrationsPath        string
+	SecretKey             string
+	AdminToken            string
+	TrustedClientToken    string
+	TrustedProxies        string
 	MemoryUsageLimitBytes uint64
+	ReapInterval          time.Duration
+	CompactInterval       time.Duration
+	AliasStrategy         string
+	AliasLength           int
+	ShortenRateLimit      float64
+	ShortenBurst          int
+	RedirectRateLimit     float64
+	RedirectBurst         int
+	IssueRateLimit        float64
+	IssueBurst            int
+	DBMaxConns            int
+	DBMinConns            int
+	DBMaxConnLifetime     time.Duration
+	DBHealthCheckPeriod   time.Duration
+	IdempotencyWindow     time.Duration
+	CacheSize             int
+	CacheTTL              time.Duration
+	EvictionPolicy        string
+	SpillEvicted          bool
+	MemoryShards          int
 }
 
 var cfg ServerConf
@@ -28,8 +59,35 @@ func init() {
 	flag.Float64Var(&limit, "memlimit", 1, "memory usage limit in Gb")
 	flag.StringVar(&cfg.Env, "env", "dev", "environment: dev or prod")
 	flag.StringVar(&cfg.FileStoragePath, "f", "", "filepath to store dump")
+	flag.StringVar(&cfg.DumpSync, "dump-fsync", "100ms", "when the dump file is fsynced: always, never or an interval such as 100ms")
+	flag.StringVar(&cfg.SnapshotCompression, "snapshot-compression", "zstd", "compression of dump file snapshots: none, gzip or zstd")
+	flag.StringVar(&cfg.DumpKeyFile, "dump-key-file", "", "file with keys to encrypt the dump file with, one <id>:<base64 key> per line, the last one current")
+	flag.DurationVar(&cfg.CompactInterval, "compact-interval", time.Hour, "interval between compactions of the dump file, 0 disables periodic compaction")
 	flag.StringVar(&cfg.DBDSN, "d", "", "database dsn")
 	flag.StringVar(&cfg.MigrationsPath, "mp", "file://migrations", "path to migrations, exp.: file://migrations")
+	flag.StringVar(&cfg.SecretKey, "s", "", "secret key to sign auth cookies, required outside the dev environment")
+	flag.StringVar(&cfg.AdminToken, "admin-token", "", "bearer token of admin endpoints, empty disables them")
+	flag.StringVar(&cfg.TrustedClientToken, "trusted-client-token", "", "bearer token of clients allowed to ask for specific aliases in batches, empty allows none")
+	flag.StringVar(&cfg.TrustedProxies, "trusted-proxies", "", "comma-separated addresses or CIDR ranges of proxies whose X-Forwarded-For and X-Real-IP are believed")
+	flag.StringVar(&cfg.AliasStrategy, "alias-strategy", "random", "alias generation strategy: random, base62, counter or hash")
+	flag.IntVar(&cfg.AliasLength, "alias-length", 8, "length of generated aliases")
+	flag.Float64Var(&cfg.ShortenRateLimit, "shorten-rps", 10, "shortening requests per second allowed per client, 0 disables limiting")
+	flag.IntVar(&cfg.ShortenBurst, "shorten-burst", 20, "burst of shortening requests allowed per client")
+	flag.Float64Var(&cfg.RedirectRateLimit, "redirect-rps", 100, "redirects per second allowed per client, 0 disables limiting")
+	flag.IntVar(&cfg.RedirectBurst, "redirect-burst", 200, "burst of redirects allowed per client")
+	flag.Float64Var(&cfg.IssueRateLimit, "issue-rps", 1, "new user cookies per second issued per client address, 0 disables limiting")
+	flag.IntVar(&cfg.IssueBurst, "issue-burst", 20, "burst of new user cookies issued per client address")
+	flag.IntVar(&cfg.DBMaxConns, "db-max-conns", 10, "maximum number of database connections")
+	flag.IntVar(&cfg.DBMinConns, "db-min-conns", 0, "minimum number of idle database connections")
+	flag.DurationVar(&cfg.DBMaxConnLifetime, "db-max-conn-lifetime", time.Hour, "maximum lifetime of a database connection")
+	flag.DurationVar(&cfg.DBHealthCheckPeriod, "db-health-check-period", time.Minute, "interval between health checks of idle database connections")
+	flag.DurationVar(&cfg.IdempotencyWindow, "idempotency-window", 24*time.Hour, "how long responses to requests with an Idempotency-Key are kept, 0 disables idempotency keys")
+	flag.IntVar(&cfg.CacheSize, "cache-size", 10_000, "maximum number of cached redirect lookups, 0 disables the cache")
+	flag.DurationVar(&cfg.CacheTTL, "cache-ttl", time.Minute, "how long a redirect lookup is cached")
+	flag.StringVar(&cfg.EvictionPolicy, "eviction-policy", "reject", "what the full in-memory storage does with new urls: reject, lru or lfu")
+	flag.BoolVar(&cfg.SpillEvicted, "spill-evicted", false, "write urls evicted from the in-memory storage to the dump file")
+	flag.IntVar(&cfg.MemoryShards, "memory-shards", 32, "number of independently locked shards of the in-memory storage")
+	flag.DurationVar(&cfg.ReapInterval, "reap", time.Minute, "interval between purges of expired urls, 0 disables purging")
 }
 
 func MustLoad() *ServerConf {
@@ -59,9 +117,145 @@ func MustLoad() *ServerConf {
 	if filename, ok := os.LookupEnv("FILE_STORAGE_PATH"); ok {
 		cfg.FileStoragePath = filename
 	}
+	if compression, ok := os.LookupEnv("SNAPSHOT_COMPRESSION"); ok {
+		cfg.SnapshotCompression = compression
+	}
+	if keyFile, ok := os.LookupEnv("DUMP_KEY_FILE"); ok {
+		cfg.DumpKeyFile = keyFile
+	}
+	// Keys are only taken from the environment, so they do not show up in
+	// the process list. They take precedence over the key file.
+	if keys, ok := os.LookupEnv("DUMP_ENCRYPTION_KEYS"); ok {
+		cfg.DumpKeys = keys
+	}
+	if compactInterval, ok := os.LookupEnv("COMPACT_INTERVAL"); ok {
+		cfg.CompactInterval = mustParseDuration("COMPACT_INTERVAL", compactInterval)
+	}
 	if dbURL, ok := os.LookupEnv("DATABASE_DSN"); ok {
 		cfg.DBDSN = dbURL
 	}
+	if secretKey, ok := os.LookupEnv("SECRET_KEY"); ok {
+		cfg.SecretKey = secretKey
+	}
+	if proxies, ok := os.LookupEnv("TRUSTED_PROXIES"); ok {
+		cfg.TrustedProxies = proxies
+	}
+	if adminToken, ok := os.LookupEnv("ADMIN_TOKEN"); ok {
+		cfg.AdminToken = adminToken
+	}
+	if trustedClientToken, ok := os.LookupEnv("TRUSTED_CLIENT_TOKEN"); ok {
+		cfg.TrustedClientToken = trustedClientToken
+	}
+	if aliasStrategy, ok := os.LookupEnv("ALIAS_STRATEGY"); ok {
+		cfg.AliasStrategy = aliasStrategy
+	}
+	if aliasLength, ok := os.LookupEnv("ALIAS_LENGTH"); ok {
+		cfg.AliasLength = mustParseInt("ALIAS_LENGTH", aliasLength)
+	}
+	if rate, ok := os.LookupEnv("SHORTEN_RATE_LIMIT"); ok {
+		cfg.ShortenRateLimit = mustParseFloat("SHORTEN_RATE_LIMIT", rate)
+	}
+	if burst, ok := os.LookupEnv("SHORTEN_BURST"); ok {
+		cfg.ShortenBurst = mustParseInt("SHORTEN_BURST", burst)
+	}
+	if rate, ok := os.LookupEnv("REDIRECT_RATE_LIMIT"); ok {
+		cfg.RedirectRateLimit = mustParseFloat("REDIRECT_RATE_LIMIT", rate)
+	}
+	if burst, ok := os.LookupEnv("REDIRECT_BURST"); ok {
+		cfg.RedirectBurst = mustParseInt("REDIRECT_BURST", burst)
+	}
+	if rate, ok := os.LookupEnv("ISSUE_RATE_LIMIT"); ok {
+		cfg.IssueRateLimit = mustParseFloat("ISSUE_RATE_LIMIT", rate)
+	}
+	if burst, ok := os.LookupEnv("ISSUE_BURST"); ok {
+		cfg.IssueBurst = mustParseInt("ISSUE_BURST", burst)
+	}
+	if maxConns, ok := os.LookupEnv("DB_MAX_CONNS"); ok {
+		cfg.DBMaxConns = mustParseInt("DB_MAX_CONNS", maxConns)
+	}
+	if minConns, ok := os.LookupEnv("DB_MIN_CONNS"); ok {
+		cfg.DBMinConns = mustParseInt("DB_MIN_CONNS", minConns)
+	}
+	if lifetime, ok := os.LookupEnv("DB_MAX_CONN_LIFETIME"); ok {
+		cfg.DBMaxConnLifetime = mustParseDuration("DB_MAX_CONN_LIFETIME", lifetime)
+	}
+	if period, ok := os.LookupEnv("DB_HEALTH_CHECK_PERIOD"); ok {
+		cfg.DBHealthCheckPeriod = mustParseDuration("DB_HEALTH_CHECK_PERIOD", period)
+	}
+	if window, ok := os.LookupEnv("IDEMPOTENCY_WINDOW"); ok {
+		cfg.IdempotencyWindow = mustParseDuration("IDEMPOTENCY_WINDOW", window)
+	}
+	if dumpSync, ok := os.LookupEnv("DUMP_FSYNC"); ok {
+		cfg.DumpSync = dumpSync
+	}
+	if cacheSize, ok := os.LookupEnv("CACHE_SIZE"); ok {
+		cfg.CacheSize = mustParseInt("CACHE_SIZE", cacheSize)
+	}
+	if cacheTTL, ok := os.LookupEnv("CACHE_TTL"); ok {
+		cfg.CacheTTL = mustParseDuration("CACHE_TTL", cacheTTL)
+	}
+	if policy, ok := os.LookupEnv("EVICTION_POLICY"); ok {
+		cfg.EvictionPolicy = policy
+	}
+	if spill, ok := os.LookupEnv("SPILL_EVICTED"); ok {
+		cfg.SpillEvicted = mustParseBool("SPILL_EVICTED", spill)
+	}
+	if shards, ok := os.LookupEnv("MEMORY_SHARDS"); ok {
+		cfg.MemoryShards = mustParseInt("MEMORY_SHARDS", shards)
+	}
+	if reapInterval, ok := os.LookupEnv("REAP_INTERVAL"); ok {
+		cfg.ReapInterval = mustParseDuration("REAP_INTERVAL", reapInterval)
+	}
+
+	if cfg.SecretKey == "" {
+		if cfg.Env != "dev" {
+			log.Fatalf("secret key is required in the %s environment, set SECRET_KEY or -s", cfg.Env)
+		}
+		cfg.SecretKey = randomSecretKey()
+		log.Println("no secret key is set, auth cookies are signed with a random key and will not survive a restart")
+	}
 
 	return &cfg
 }
+
+// randomSecretKey returns a key good for a single process, so that a dev
+// server never signs cookies with a key known to everyone.
+func randomSecretKey() string {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		log.Fatalf("failed to generate secret key: %v", err)
+	}
+	return hex.EncodeToString(key)
+}
+
+func mustParseInt(name, value string) int {
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		log.Fatalf("failed to parse %s: %v", name, err)
+	}
+	return n
+}
+
+func mustParseFloat(name, value string) float64 {
+	n, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		log.Fatalf("failed to parse %s: %v", name, err)
+	}
+	return n
+}
+
+func mustParseBool(name, value string) bool {
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		log.Fatalf("failed to parse %s: %v", name, err)
+	}
+	return b
+}
+
+func mustParseDuration(name, value string) time.Duration {
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		log.Fatalf("failed to parse %s: %v", name, err)
+	}
+	return d
+}
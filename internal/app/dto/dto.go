@@ -1,11 +1,133 @@
 package dto
 
+import "time"
+
+// OriginalURL is a single item of a batch shortening request. ID is only
+// echoed back to the client, the public alias is generated by the service
+// unless Alias is explicitly requested.
 type OriginalURL struct {
-	ID  string `json:"correlation_id"`
-	URL string `json:"original_url"`
+	ID         string     `json:"correlation_id"`
+	URL        string     `json:"original_url"`
+	Alias      string     `json:"alias,omitempty"`
+	ExpiresAt  *time.Time `json:"expires_at,omitempty"`
+	TTLSeconds int64      `json:"ttl_seconds,omitempty"`
+}
+
+// ShortenOptions holds optional parameters of a single shortening request.
+type ShortenOptions struct {
+	Alias      string
+	ExpiresAt  *time.Time
+	TTLSeconds int64
+}
+
+// BatchOptions holds optional parameters of a batch shortening request.
+type BatchOptions struct {
+	// Atomic rejects the whole batch if any of its items is invalid.
+	Atomic bool
 }
 
+const (
+	StatusCreated  = "created"
+	StatusExisting = "existing"
+	StatusInvalid  = "invalid"
+)
+
 type ShortedURL struct {
-	ID  string `json:"correlation_id"`
-	URL string `json:"short_url"`
+	ID     string `json:"correlation_id"`
+	URL    string `json:"short_url,omitempty"`
+	Status string `json:"status,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+// IdempotentResponse is a response remembered for an Idempotency-Key,
+// together with the hash of the request it has been produced for. A
+// response without a status code is still being produced.
+type IdempotentResponse struct {
+	RequestHash string
+	StatusCode  int
+	ContentType string
+	Body        []byte
+}
+
+// InFlight reports whether the request of the response is still handled.
+func (r IdempotentResponse) InFlight() bool {
+	return r.StatusCode == 0
+}
+
+type UserURL struct {
+	ShortURL    string `json:"short_url"`
+	OriginalURL string `json:"original_url"`
+}
+
+type Click struct {
+	Alias     string
+	ClickedAt time.Time
+	Referrer  string
+	UserAgent string
+	IP        string
+}
+
+type LinkStats struct {
+	Alias          string         `json:"alias"`
+	From           time.Time      `json:"from"`
+	To             time.Time      `json:"to"`
+	TotalClicks    int64          `json:"total_clicks"`
+	UniqueVisitors int64          `json:"unique_visitors"`
+	ClicksPerDay   []DailyClicks  `json:"clicks_per_day"`
+	TopReferrers   []CountedValue `json:"top_referrers"`
+	TopUserAgents  []CountedValue `json:"top_user_agents"`
+}
+
+type DailyClicks struct {
+	Date   string `json:"date"`
+	Clicks int64  `json:"clicks"`
+}
+
+type CountedValue struct {
+	Value string `json:"value"`
+	Count int64  `json:"count"`
+}
+
+type Diagnostics struct {
+	Aliases AliasDiagnostics `json:"aliases"`
+	Pool    *PoolStats       `json:"pool,omitempty"`
+	Memory  *MemoryStats     `json:"memory,omitempty"`
+}
+
+// MemoryStats reports the memory taken by links of the in-memory storage.
+type MemoryStats struct {
+	UsedBytes  uint64 `json:"used_bytes"`
+	PeakBytes  uint64 `json:"peak_bytes"`
+	LimitBytes uint64 `json:"limit_bytes"`
+	Links      int    `json:"links"`
+}
+
+type AliasDiagnostics struct {
+	Length           int    `json:"length"`
+	Attempts         uint64 `json:"attempts"`
+	Collisions       uint64 `json:"collisions"`
+	Resizes          uint64 `json:"resizes"`
+	WindowAttempts   int    `json:"window_attempts"`
+	WindowCollisions int    `json:"window_collisions"`
+}
+
+type PoolStats struct {
+	TotalConns           int32  `json:"total_conns"`
+	IdleConns            int32  `json:"idle_conns"`
+	AcquiredConns        int32  `json:"acquired_conns"`
+	ConstructingConns    int32  `json:"constructing_conns"`
+	MaxConns             int32  `json:"max_conns"`
+	AcquireCount         int64  `json:"acquire_count"`
+	EmptyAcquireCount    int64  `json:"empty_acquire_count"`
+	CanceledAcquireCount int64  `json:"canceled_acquire_count"`
+	AcquireDuration      string `json:"acquire_duration"`
+	NewConnsCount        int64  `json:"new_conns_count"`
+}
+
+// Compaction reports a compaction of the dump file.
+type Compaction struct {
+	Links         int    `json:"links"`
+	SnapshotBytes int64  `json:"snapshot_bytes"`
+	ReplacedBytes int64  `json:"replaced_bytes"`
+	Duration      string `json:"duration"`
 }
@@ -0,0 +1,151 @@
+// Package keyring seals data with AES-GCM under numbered keys, so that keys
+// can be rotated while data sealed under older keys stays readable.
+//
+// Keys are given as "<id>:<base64 key>" entries separated by commas or
+// newlines, for example "1:q6Jg...,2:Zm9v...". The id is a positive
+// integer and the key is 16, 24 or 32 bytes long, selecting AES-128,
+// AES-192 or AES-256. The last entry is the current key, which seals new
+// data; the others only open data sealed before. To rotate keys, append a
+// new entry and keep the older ones for as long as data sealed under them
+// is around.
+//
+// Sealed data is laid out as a marker byte, the 4 byte big-endian key id,
+// the 12 byte nonce and the ciphertext. Nonces are random, so a key should
+// be rotated well before it seals 2^32 messages.
+package keyring
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// marker starts sealed data. Dump records in plain text are JSON objects
+// and start with '{' instead.
+const marker = 0x01
+
+const headerSize = 1 + 4
+
+var (
+	ErrNoKeys     = errors.New("no keys given")
+	ErrUnknownKey = errors.New("data is sealed under an unknown key")
+	ErrNotSealed  = errors.New("data is not sealed")
+)
+
+// Keyring holds the keys data is sealed under.
+type Keyring struct {
+	current uint32
+	aeads   map[uint32]cipher.AEAD
+}
+
+// Parse parses keys in the format described in the package documentation.
+func Parse(keys string) (*Keyring, error) {
+	k := &Keyring{aeads: make(map[uint32]cipher.AEAD)}
+	entries := strings.FieldsFunc(keys, func(r rune) bool {
+		return r == ',' || r == '\n' || r == '\r'
+	})
+	for _, entry := range entries {
+		entry = strings.TrimSpace(entry)
+		if entry == "" || strings.HasPrefix(entry, "#") {
+			continue
+		}
+		idText, keyText, ok := strings.Cut(entry, ":")
+		if !ok {
+			return nil, fmt.Errorf("key entry is not <id>:<base64 key>")
+		}
+		id, err := strconv.ParseUint(strings.TrimSpace(idText), 10, 32)
+		if err != nil || id == 0 {
+			return nil, fmt.Errorf("invalid key id %q", idText)
+		}
+		key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(keyText))
+		if err != nil {
+			return nil, fmt.Errorf("key %d is not base64: %w", id, err)
+		}
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, fmt.Errorf("key %d: %w", id, err)
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := k.aeads[uint32(id)]; ok {
+			return nil, fmt.Errorf("duplicate key id %d", id)
+		}
+		k.aeads[uint32(id)] = aead
+		k.current = uint32(id)
+	}
+	if len(k.aeads) == 0 {
+		return nil, ErrNoKeys
+	}
+	return k, nil
+}
+
+// Load parses the keys kept in the file at path.
+func Load(path string) (*Keyring, error) {
+	keys, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return Parse(string(keys))
+}
+
+// KeyID returns the id of the current key.
+func (k *Keyring) KeyID() uint32 {
+	return k.current
+}
+
+// Seal encrypts and authenticates plaintext together with additionalData,
+// which is not included in the result and has to be passed to Open again.
+func (k *Keyring) Seal(plaintext, additionalData []byte) []byte {
+	aead := k.aeads[k.current]
+	sealed := make([]byte, headerSize+aead.NonceSize(), headerSize+aead.NonceSize()+len(plaintext)+aead.Overhead())
+	sealed[0] = marker
+	binary.BigEndian.PutUint32(sealed[1:headerSize], k.current)
+	nonce := sealed[headerSize:]
+	if _, err := rand.Read(nonce); err != nil {
+		panic(fmt.Sprintf("keyring: failed to generate nonce: %v", err))
+	}
+	return aead.Seal(sealed, nonce, plaintext, withHeader(additionalData, sealed[:headerSize]))
+}
+
+// Open decrypts data sealed by Seal under any key of the keyring.
+func (k *Keyring) Open(sealed, additionalData []byte) ([]byte, error) {
+	if !IsSealed(sealed) {
+		return nil, ErrNotSealed
+	}
+	id := binary.BigEndian.Uint32(sealed[1:headerSize])
+	aead, ok := k.aeads[id]
+	if !ok {
+		return nil, fmt.Errorf("%w: %d", ErrUnknownKey, id)
+	}
+	if len(sealed) < headerSize+aead.NonceSize()+aead.Overhead() {
+		return nil, errors.New("sealed data is too short")
+	}
+	nonce := sealed[headerSize : headerSize+aead.NonceSize()]
+	ciphertext := sealed[headerSize+aead.NonceSize():]
+	return aead.Open(nil, nonce, ciphertext, withHeader(additionalData, sealed[:headerSize]))
+}
+
+// IsCurrent reports whether sealed is sealed under the current key.
+func (k *Keyring) IsCurrent(sealed []byte) bool {
+	return IsSealed(sealed) && binary.BigEndian.Uint32(sealed[1:headerSize]) == k.current
+}
+
+// IsSealed reports whether data looks sealed by a keyring.
+func IsSealed(data []byte) bool {
+	return len(data) >= headerSize && data[0] == marker
+}
+
+// withHeader binds the key id to the ciphertext, so that it cannot be
+// swapped for another one.
+func withHeader(additionalData, header []byte) []byte {
+	return append(append(make([]byte, 0, len(additionalData)+len(header)), additionalData...), header...)
+}
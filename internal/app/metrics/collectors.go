@@ -0,0 +1,39 @@
+package metrics
+
+var (
+	HTTPRequests = NewCounterVec(
+		"shortener_http_requests_total",
+		"Number of handled HTTP requests.",
+		"route", "method", "status",
+	)
+	HTTPRequestDuration = NewHistogramVec(
+		"shortener_http_request_duration_seconds",
+		"Latency of handled HTTP requests.",
+		DefBuckets,
+		"route", "method", "status",
+	)
+	Redirects = NewCounterVec(
+		"shortener_redirects_total",
+		"Number of redirect lookups by result: hit, miss or gone.",
+		"result",
+	)
+	RedirectCache = NewCounterVec(
+		"shortener_redirect_cache_requests_total",
+		"Number of redirect cache lookups by result: hit or miss.",
+		"result",
+	)
+	Evictions = NewCounterVec(
+		"shortener_memory_storage_evictions_total",
+		"Number of links evicted from the full in-memory storage.",
+	)
+	AliasCollisions = NewCounterVec(
+		"shortener_alias_collisions_total",
+		"Number of generated aliases rejected as already taken.",
+	)
+	StorageOperationDuration = NewHistogramVec(
+		"shortener_storage_operation_duration_seconds",
+		"Latency of storage operations.",
+		DefBuckets,
+		"backend", "operation",
+	)
+)
@@ -0,0 +1,160 @@
+package repository
+
+import (
+	"container/list"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/DeneesK/short-url/internal/app/storage"
+)
+
+// linkCache is a bounded LRU cache of redirect lookups. Besides found links
+// it remembers lookups of unknown, deleted and expired aliases.
+type linkCache struct {
+	m       sync.Mutex
+	size    int
+	ttl     time.Duration
+	entries map[string]*list.Element
+	order   *list.List
+	// flights are the lookups in flight by alias. Invalidating an alias
+	// bumps the version of its flight and a flush bumps flushes, so that a
+	// lookup that raced with either does not put a stale result back.
+	flights map[string]*flight
+	flushes uint64
+}
+
+type flight struct {
+	version uint64
+	lookups int
+}
+
+// lookup is a lookup in flight, begun with begin and finished with finish.
+type lookup struct {
+	alias   string
+	version uint64
+	flushes uint64
+}
+
+type cacheEntry struct {
+	alias       string
+	link        storage.Link
+	err         error
+	cachedUntil time.Time
+}
+
+func newLinkCache(size int, ttl time.Duration) *linkCache {
+	return &linkCache{
+		size:    size,
+		ttl:     ttl,
+		entries: make(map[string]*list.Element, size),
+		order:   list.New(),
+		flights: make(map[string]*flight),
+	}
+}
+
+// isCacheable reports whether a failed lookup may be cached.
+func isCacheable(err error) bool {
+	return errors.Is(err, storage.ErrNotFound) ||
+		errors.Is(err, storage.ErrDeleted) ||
+		errors.Is(err, storage.ErrExpired)
+}
+
+func (c *linkCache) get(alias string) (cacheEntry, bool) {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	el, ok := c.entries[alias]
+	if !ok {
+		return cacheEntry{}, false
+	}
+	entry := el.Value.(*cacheEntry)
+	now := time.Now()
+	if !entry.cachedUntil.After(now) {
+		c.remove(el)
+		return cacheEntry{}, false
+	}
+	if entry.err == nil && entry.link.ExpiresAt != nil && !entry.link.ExpiresAt.After(now) {
+		entry.link = storage.Link{}
+		entry.err = storage.ErrExpired
+	}
+	c.order.MoveToFront(el)
+	return *entry, true
+}
+
+// begin starts a lookup of alias in the storage.
+func (c *linkCache) begin(alias string) lookup {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	f, ok := c.flights[alias]
+	if !ok {
+		f = &flight{}
+		c.flights[alias] = f
+	}
+	f.lookups++
+	return lookup{alias: alias, version: f.version, flushes: c.flushes}
+}
+
+// finish caches the outcome of l, unless it is not cacheable or the alias
+// has been invalidated since l began.
+func (c *linkCache) finish(l lookup, link storage.Link, err error) {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	f := c.flights[l.alias]
+	stale := f.version != l.version || c.flushes != l.flushes
+	if f.lookups--; f.lookups == 0 {
+		delete(c.flights, l.alias)
+	}
+	if stale || err != nil && !isCacheable(err) {
+		return
+	}
+	entry := &cacheEntry{alias: l.alias, link: link, err: err, cachedUntil: time.Now().Add(c.ttl)}
+	if el, ok := c.entries[l.alias]; ok {
+		el.Value = entry
+		c.order.MoveToFront(el)
+		return
+	}
+	c.entries[l.alias] = c.order.PushFront(entry)
+	for c.order.Len() > c.size {
+		c.remove(c.order.Back())
+	}
+}
+
+// invalidate drops cached lookups of aliases and outdates the ones in
+// flight. Lookups of other aliases are not affected.
+func (c *linkCache) invalidate(aliases ...string) {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	for _, alias := range aliases {
+		if el, ok := c.entries[alias]; ok {
+			c.remove(el)
+		}
+		if f, ok := c.flights[alias]; ok {
+			f.version++
+		}
+	}
+}
+
+// flush drops every cached lookup.
+func (c *linkCache) flush() {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	c.flushes++
+	c.entries = make(map[string]*list.Element, c.size)
+	c.order.Init()
+}
+
+func (c *linkCache) len() int {
+	c.m.Lock()
+	defer c.m.Unlock()
+	return c.order.Len()
+}
+
+func (c *linkCache) remove(el *list.Element) {
+	c.order.Remove(el)
+	delete(c.entries, el.Value.(*cacheEntry).alias)
+}
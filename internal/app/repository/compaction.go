@@ -0,0 +1,237 @@
+package repository
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"time"
+
+	"github.com/DeneesK/short-url/internal/app/dto"
+	"github.com/DeneesK/short-url/internal/app/snapshot"
+	"github.com/DeneesK/short-url/internal/app/storage"
+	"github.com/DeneesK/short-url/internal/app/storage/memorystorage"
+	"github.com/DeneesK/short-url/internal/app/wal"
+)
+
+const (
+	snapshotSuffix    = ".snapshot"
+	nextSegmentSuffix = ".next"
+	tmpSuffix         = ".tmp"
+)
+
+type snapshotter interface {
+	Snapshot() map[string]memorystorage.Link
+}
+
+// tombstoner restores links that are deleted and keep no long URL.
+type tombstoner interface {
+	StoreDeleted(id, userID string, expiresAt *time.Time) error
+}
+
+// dumpSegments lists the dump files replayed after the snapshot, in order.
+func dumpSegments(dumpFilePath string) []string {
+	return []string{dumpFilePath, dumpFilePath + nextSegmentSuffix}
+}
+
+// Compact writes the live links to a snapshot next to the dump file and
+// starts the dump afresh, so that restoring does not replay the whole
+// history of the storage.
+//
+// Writes go to a new dump segment from the moment the storage is about to
+// be copied, and that segment replaces the dump once the snapshot is in
+// place. The copy is taken without blocking writes, so it may have some of
+// the writes in the new segment as well, which replaying the segment after
+// the snapshot tolerates. Both files are replaced by renames and
+// RestoreFromDump replays the snapshot, the dump and the new segment, so a
+// crash at any point loses nothing.
+func (rep *Repository) Compact(ctx context.Context) (dto.Compaction, error) {
+	mem, ok := rep.storage.(snapshotter)
+	if !ok || rep.wal == nil {
+		return dto.Compaction{}, storage.ErrCompactionUnsupported
+	}
+	rep.compactM.Lock()
+	defer rep.compactM.Unlock()
+	start := time.Now()
+	defer rep.observe("compact", start)
+
+	replaced := filesSize(append(dumpSegments(rep.dumpPath), rep.dumpPath+snapshotSuffix)...)
+	nextPath := rep.dumpPath + nextSegmentSuffix
+
+	rep.dumpM.Lock()
+	next, err := wal.OpenWriter(nextPath, rep.dumpSync)
+	if err != nil {
+		rep.dumpM.Unlock()
+		return dto.Compaction{}, err
+	}
+	prev := rep.wal
+	rep.wal = next
+	rep.segment = nil
+	rep.dumpM.Unlock()
+
+	if err := prev.Close(); err != nil {
+		return dto.Compaction{}, err
+	}
+
+	links := mem.Snapshot()
+	rows := make([]row, 0, len(links))
+	for id, link := range links {
+		rows = append(rows, linkRow(id, link))
+	}
+	if rep.spillEvicted {
+		evicted, err := rep.spilledRows(links)
+		if err != nil {
+			return dto.Compaction{}, err
+		}
+		rows = append(rows, evicted...)
+	}
+
+	snapshotPath := rep.dumpPath + snapshotSuffix
+	if err := rep.writeSnapshot(snapshotPath, rows); err != nil {
+		return dto.Compaction{}, err
+	}
+	if err := wal.Rename(nextPath, rep.dumpPath); err != nil {
+		return dto.Compaction{}, err
+	}
+
+	return dto.Compaction{
+		Links:         len(rows),
+		SnapshotBytes: filesSize(snapshotPath),
+		ReplacedBytes: replaced,
+		Duration:      time.Since(start).String(),
+	}, nil
+}
+
+func linkRow(id string, link memorystorage.Link) row {
+	return row{
+		ShortURL:  id,
+		LongURL:   link.Value,
+		UserID:    link.UserID,
+		Deleted:   link.Deleted,
+		ExpiresAt: link.ExpiresAt,
+	}
+}
+
+// spilledRows returns the links spilled to the dump and its snapshot that
+// are not in live, so that compaction does not lose them.
+func (rep *Repository) spilledRows(live map[string]memorystorage.Link) ([]row, error) {
+	spilled := make(map[string]row)
+	collect := func(r row) error {
+		if _, ok := live[r.ShortURL]; ok {
+			return nil
+		}
+		if r.Evicted {
+			spilled[r.ShortURL] = r
+		} else if s, ok := spilled[r.ShortURL]; ok && r.Deleted && r.LongURL == "" {
+			s.Deleted = s.UserID == r.UserID
+			spilled[r.ShortURL] = s
+		}
+		return nil
+	}
+	if err := rep.replaySnapshot(rep.dumpPath+snapshotSuffix, collect); err != nil {
+		return nil, err
+	}
+	if _, err := rep.replayDump(rep.dumpPath, collect); err != nil {
+		return nil, err
+	}
+
+	rows := make([]row, 0, len(spilled))
+	for _, r := range spilled {
+		rows = append(rows, r)
+	}
+	return rows, nil
+}
+
+// writeSnapshot writes rows to a temporary file and renames it to path
+// once it is synced.
+func (rep *Repository) writeSnapshot(path string, rows []row) error {
+	tmpPath := path + tmpSuffix
+	w, err := snapshot.Create(tmpPath, rep.snapshotCompression, rep.snapshotCipher())
+	if err != nil {
+		return err
+	}
+	for _, r := range rows {
+		if err := w.Write(snapshot.Row(r)); err != nil {
+			w.Close()
+			return err
+		}
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return wal.Rename(tmpPath, path)
+}
+
+// replaySnapshot calls fn with every row of the snapshot at path. Snapshots
+// written before the binary format have the format of the dump file. A
+// missing snapshot is empty.
+func (rep *Repository) replaySnapshot(path string, fn func(row) error) error {
+	file, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	var c snapshot.Cipher
+	var opened *restoreCipher
+	if rep.keys != nil {
+		opened = &restoreCipher{keys: rep.keys}
+		c = opened
+	}
+	rows := 0
+	err = snapshot.Read(file, c, func(r snapshot.Row) error {
+		rows++
+		return fn(row(r))
+	})
+	if err == nil && opened != nil && rep.restoring && rows > 0 {
+		rep.reseal = rep.reseal || opened.stale || !opened.sealed
+	}
+	if !errors.Is(err, snapshot.ErrNotSnapshot) {
+		return err
+	}
+	_, err = rep.replayDump(path, fn)
+	return err
+}
+
+func (rep *Repository) snapshotCipher() snapshot.Cipher {
+	if rep.keys == nil {
+		return nil
+	}
+	return rep.keys
+}
+
+// replayDump calls fn with every row of the dump file at path and returns
+// the number of bytes of a torn record cut off its end. Encrypted rows are
+// decrypted, rows in plain text are read as they are.
+func (rep *Repository) replayDump(path string, fn func(row) error) (int64, error) {
+	var segment []byte
+	var seq uint64
+	return wal.Replay(path, func(data []byte) error {
+		if id, ok := parseSegmentHeader(data); ok {
+			segment, seq = id, 0
+			return nil
+		}
+		data, err := rep.openRow(data, segment, seq)
+		if err != nil {
+			return err
+		}
+		seq++
+		r := row{}
+		if err := json.Unmarshal(data, &r); err != nil {
+			return err
+		}
+		return fn(r)
+	})
+}
+
+func filesSize(paths ...string) int64 {
+	var size int64
+	for _, path := range paths {
+		if info, err := os.Stat(path); err == nil {
+			size += info.Size()
+		}
+	}
+	return size
+}
@@ -1,60 +1,162 @@
 package repository
 
 import (
-	"bufio"
 	"context"
 	"encoding/json"
 	"errors"
 	"os"
+	"sync"
+	"time"
 
 	"github.com/DeneesK/short-url/internal/app/dto"
+	"github.com/DeneesK/short-url/internal/app/keyring"
+	"github.com/DeneesK/short-url/internal/app/metrics"
+	"github.com/DeneesK/short-url/internal/app/snapshot"
 	"github.com/DeneesK/short-url/internal/app/storage"
 	"github.com/DeneesK/short-url/internal/app/storage/memorystorage"
 	"github.com/DeneesK/short-url/internal/app/storage/postgres"
+	"github.com/DeneesK/short-url/internal/app/wal"
+	"go.uber.org/zap"
 )
 
-const filePerm = 0644
+var ErrDumpEncrypted = errors.New("dump file is encrypted and no key is given")
 
 type StorageConfig struct {
 	DBDSN           string
 	MigrationSource string
 	MaxStorageSize  uint64
+	DBPool          postgres.PoolConfig
+	// EvictionPolicy, SpillEvicted and MemoryShards only apply to the
+	// in-memory storage.
+	EvictionPolicy string
+	SpillEvicted   bool
+	MemoryShards   int
+	// DumpSync is the fsync policy of the dump file: always, never or an
+	// interval such as 100ms.
+	DumpSync string
+	// SnapshotCompression compresses snapshots of the dump file: none,
+	// gzip or zstd.
+	SnapshotCompression string
+	// DumpKeys encrypt the dump file and its snapshots, unless nil. Rows
+	// are sealed under the current key when written and again when the
+	// dump is compacted, so after a rotation the older keys are needed
+	// until the next compaction. A restore that comes across rows in plain
+	// text or sealed under an older key compacts the dump right away.
+	DumpKeys *keyring.Keyring
 }
 
 type row struct {
-	ShortURL string `json:"short_url"`
-	LongURL  string `json:"long_url"`
+	ShortURL  string     `json:"short_url"`
+	LongURL   string     `json:"long_url"`
+	UserID    string     `json:"user_id,omitempty"`
+	Deleted   bool       `json:"is_deleted,omitempty"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	Evicted   bool       `json:"is_evicted,omitempty"`
 }
 
 type Storage interface {
-	Store(context.Context, string, string) (string, error)
-	StoreBatch(ctx context.Context, batch []dto.OriginalURL) error
-	Get(ctx context.Context, id string) (string, error)
+	Store(ctx context.Context, id, value, userID string, expiresAt *time.Time) (string, error)
+	StoreBatch(ctx context.Context, batch []dto.OriginalURL, userID string, atomic bool) ([]storage.BatchResult, error)
+	Get(ctx context.Context, id string) (storage.Link, error)
+	GetByUserID(ctx context.Context, userID string) ([]dto.UserURL, error)
+	DeleteBatch(ctx context.Context, userID string, aliases []string) error
+	PurgeExpired(ctx context.Context) (int, error)
+	StoreClicks(ctx context.Context, clicks []dto.Click) error
+	GetOwner(ctx context.Context, id string) (string, error)
+	ClickStats(ctx context.Context, alias string, from, to time.Time, top int) (dto.LinkStats, error)
+	ReserveResponse(ctx context.Context, key, requestHash string, expiresAt time.Time) (dto.IdempotentResponse, bool, error)
+	SaveResponse(ctx context.Context, key string, resp dto.IdempotentResponse, expiresAt time.Time) error
+	ReleaseResponse(ctx context.Context, key string) error
 	Close(ctx context.Context) error
 	Ping(ctx context.Context) error
 }
 
+const (
+	backendPostgres = "postgres"
+	backendMemory   = "memory"
+)
+
+// Logger reports what happens to the dump file in the background or while
+// restoring.
+type Logger interface {
+	Infoln(args ...interface{})
+	Errorf(template string, args ...interface{})
+}
+
 type Repository struct {
-	storage Storage
-	file    *os.File
-	encoder *json.Encoder
+	storage      Storage
+	backend      string
+	wal          *wal.Writer
+	dumpPath     string
+	dumpSync     wal.SyncPolicy
+	cache        *linkCache
+	spillEvicted bool
+	restoring    bool
+	log          Logger
+
+	snapshotCompression snapshot.Compression
+	keys                *keyring.Keyring
+	// segment and seq are the id of the encrypted dump segment being
+	// written and the number of rows in it, guarded by appendM.
+	segment []byte
+	seq     uint64
+	// reseal is set by a restore that comes across rows not sealed under
+	// the current key.
+	reseal bool
+	// dumpM is held for reading by writes, which go to the storage and the
+	// dump together, and for writing by a compaction switching the dump.
+	dumpM    sync.RWMutex
+	compactM sync.Mutex
+	appendM  sync.Mutex
 }
 
 type Option func(*Repository) error
 
 func NewRepository(conf StorageConfig, opts ...Option) (*Repository, error) {
-	var storage Storage
+	dumpSync, err := wal.ParseSyncPolicy(conf.DumpSync)
+	if err != nil {
+		return nil, err
+	}
+	compression, err := snapshot.ParseCompression(conf.SnapshotCompression)
+	if err != nil {
+		return nil, err
+	}
+	rep := &Repository{
+		backend:             backendMemory,
+		spillEvicted:        conf.SpillEvicted,
+		dumpSync:            dumpSync,
+		snapshotCompression: compression,
+		keys:                conf.DumpKeys,
+		log:                 zap.NewNop().Sugar(),
+	}
 	if conf.DBDSN != "" {
 		ctx := context.Background()
-		storage = postgres.NewDBConnection(
-			ctx, conf.DBDSN,
+		rep.storage = postgres.NewDBConnection(
+			ctx, conf.DBDSN, conf.DBPool,
 			postgres.RunMigrations(conf.MigrationSource, conf.DBDSN),
 		)
+		rep.backend = backendPostgres
 	} else {
-		storage = memorystorage.NewMemoryStorage(conf.MaxStorageSize)
-	}
-	rep := &Repository{
-		storage: storage,
+		policy, err := memorystorage.ParseEvictionPolicy(conf.EvictionPolicy)
+		if err != nil {
+			return nil, err
+		}
+		memStorage := memorystorage.NewMemoryStorage(
+			conf.MaxStorageSize,
+			memorystorage.WithEvictionPolicy(policy),
+			memorystorage.WithEvictionHandler(rep.evicted),
+			memorystorage.WithShards(conf.MemoryShards),
+		)
+		metrics.SetGaugeFunc("shortener_memory_storage_bytes", "Estimated bytes used by the in-memory storage.", func() float64 {
+			return float64(memStorage.Stats().UsedBytes)
+		})
+		metrics.SetGaugeFunc("shortener_memory_storage_peak_bytes", "Peak bytes used by the in-memory storage.", func() float64 {
+			return float64(memStorage.Stats().PeakBytes)
+		})
+		metrics.SetGaugeFunc("shortener_memory_storage_limit_bytes", "Memory limit of the in-memory storage.", func() float64 {
+			return float64(memStorage.Stats().LimitBytes)
+		})
+		rep.storage = memStorage
 	}
 
 	for _, opt := range opts {
@@ -66,84 +168,310 @@ func NewRepository(conf StorageConfig, opts ...Option) (*Repository, error) {
 	return rep, nil
 }
 
+// WithLogger logs to log, and so does the Postgres storage. It goes before
+// the options that open and restore the dump file.
+func WithLogger(log Logger) Option {
+	return func(rep *Repository) error {
+		rep.log = log
+		if db, ok := rep.storage.(*postgres.PostgresStorage); ok {
+			return postgres.WithLogger(log)(db)
+		}
+		return nil
+	}
+}
+
 func AddDumpFile(dumpFilePath string) Option {
 	return func(rep *Repository) error {
 		if dumpFilePath == "" {
 			return nil
 		}
-		file, err := os.OpenFile(dumpFilePath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, filePerm)
+		w, err := wal.OpenWriter(dumpFilePath, rep.dumpSync)
 		if err != nil {
 			return err
 		}
-		rep.file = file
-		rep.encoder = json.NewEncoder(rep.file)
+		rep.wal = w
+		rep.dumpPath = dumpFilePath
+		metrics.SetGaugeFunc("shortener_dump_file_bytes", "Size of the dump file.", func() float64 {
+			rep.dumpM.RLock()
+			defer rep.dumpM.RUnlock()
+			size, err := rep.wal.Size()
+			if err != nil {
+				return 0
+			}
+			return float64(size)
+		})
 		return nil
 	}
 }
 
+// WithCache puts a cache of up to size redirect lookups, each kept for at
+// most ttl, in front of the storage. Lookups of unknown, deleted and expired
+// aliases are cached too. A zero size or ttl disables the cache.
+func WithCache(size int, ttl time.Duration) Option {
+	return func(rep *Repository) error {
+		if size <= 0 || ttl <= 0 {
+			return nil
+		}
+		cache := newLinkCache(size, ttl)
+		rep.cache = cache
+		metrics.SetGaugeFunc("shortener_redirect_cache_entries", "Number of entries in the redirect cache.", func() float64 {
+			return float64(cache.len())
+		})
+		return nil
+	}
+}
+
+// RestoreFromDump replays the snapshot and the dump file into the storage.
+// A record torn by a crash and everything after it are cut off the file.
+// A compaction interrupted by a crash is finished once restored, and one is
+// run if rows are to be sealed under the current key.
 func RestoreFromDump(dumpFilePath string) Option {
 	return func(rep *Repository) error {
 		if dumpFilePath == "" {
 			return nil
 		}
-		file, err := os.OpenFile(dumpFilePath, os.O_RDONLY, filePerm)
-		if err != nil {
+		// Rows evicted while restoring are in the dump already.
+		rep.restoring = true
+		defer func() { rep.restoring = false }()
+		if err := rep.replaySnapshot(dumpFilePath+snapshotSuffix, rep.restoreSnapshotRow); err != nil {
 			return err
 		}
-		defer file.Close()
-		scanner := bufio.NewScanner(file)
-		for scanner.Scan() {
-			data := scanner.Bytes()
-
-			r := row{}
-			err := json.Unmarshal(data, &r)
+		for _, path := range dumpSegments(dumpFilePath) {
+			truncated, err := rep.replayDump(path, rep.restoreRow)
 			if err != nil {
 				return err
 			}
-			_, err = rep.storage.Store(context.Background(), r.ShortURL, r.LongURL)
-			if err != nil {
-				return err
+			if truncated > 0 {
+				rep.log.Infoln("truncated", truncated, "bytes of a torn record off", path)
 			}
+		}
 
+		nextPath := dumpFilePath + nextSegmentSuffix
+		_, err := os.Stat(nextPath)
+		if (err == nil || rep.reseal) && rep.wal != nil && rep.dumpPath == dumpFilePath {
+			if _, err := rep.Compact(context.Background()); err != nil {
+				return err
+			}
 		}
 		return nil
 	}
 }
 
-func (rep *Repository) Store(ctx context.Context, id, value string) (string, error) {
-	if alias, err := rep.storage.Store(ctx, id, value); err != nil && err != storage.ErrUniqueViolation {
+// restoreSnapshotRow restores a row of the snapshot, where a deleted row
+// without a long URL is a tombstone rather than a deletion to replay.
+func (rep *Repository) restoreSnapshotRow(r row) error {
+	if r.Deleted && r.LongURL == "" {
+		return rep.restoreTombstone(r)
+	}
+	return rep.restoreRow(r)
+}
+
+func (rep *Repository) restoreRow(r row) error {
+	ctx := context.Background()
+	// A spilled tombstone is a link like any other spilled one.
+	if r.Evicted && r.Deleted && r.LongURL == "" {
+		return rep.restoreTombstone(r)
+	}
+	if r.LongURL != "" {
+		_, err := rep.storage.Store(ctx, r.ShortURL, r.LongURL, r.UserID, r.ExpiresAt)
+		// The row may repeat one restored from the snapshot, or one stored
+		// earlier in the dump if it has been spilled.
+		if err != nil && !errors.Is(err, storage.ErrNotUniqueID) && !errors.Is(err, storage.ErrUniqueViolation) {
+			return err
+		}
+	}
+	if r.Deleted {
+		return rep.storage.DeleteBatch(ctx, r.UserID, []string{r.ShortURL})
+	}
+	return nil
+}
+
+func (rep *Repository) restoreTombstone(r row) error {
+	if t, ok := rep.storage.(tombstoner); ok {
+		return t.StoreDeleted(r.ShortURL, r.UserID, r.ExpiresAt)
+	}
+	return nil
+}
+
+func (rep *Repository) Store(ctx context.Context, id, value, userID string, expiresAt *time.Time) (string, error) {
+	defer rep.observe("store", time.Now())
+	rep.dumpM.RLock()
+	defer rep.dumpM.RUnlock()
+	if alias, err := rep.storage.Store(ctx, id, value, userID, expiresAt); err != nil && err != storage.ErrUniqueViolation {
 		return "", err
 	} else if errors.Is(err, storage.ErrUniqueViolation) {
 		return alias, storage.ErrUniqueViolation
 	}
-	if rep.encoder != nil {
-		if err := rep.storeToFile(id, value); err != nil {
+	rep.invalidate(id)
+	if rep.wal != nil {
+		if err := rep.storeToFile(id, value, userID, expiresAt); err != nil {
 			return "", err
 		}
 	}
 	return id, nil
 }
 
-func (rep *Repository) StoreBatch(ctx context.Context, batch []dto.OriginalURL) error {
+func (rep *Repository) StoreBatch(ctx context.Context, batch []dto.OriginalURL, userID string, atomic bool) ([]storage.BatchResult, error) {
+	defer rep.observe("store_batch", time.Now())
+	rep.dumpM.RLock()
+	defer rep.dumpM.RUnlock()
+
+	result, err := rep.storage.StoreBatch(ctx, batch, userID, atomic)
+	if err != nil {
+		return nil, err
+	}
+	for _, r := range result {
+		if !r.Existing && r.Err == nil {
+			rep.invalidate(r.Alias)
+		}
+	}
+
+	if rep.wal != nil {
+		for i, entry := range batch {
+			if result[i].Existing || result[i].Err != nil {
+				continue
+			}
+			if err := rep.storeToFile(entry.Alias, entry.URL, userID, entry.ExpiresAt); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return result, nil
+}
+
+func (rep *Repository) Get(ctx context.Context, id string) (string, error) {
+	if rep.cache != nil {
+		if entry, ok := rep.cache.get(id); ok {
+			metrics.RedirectCache.Inc("hit")
+			return entry.link.Value, entry.err
+		}
+		metrics.RedirectCache.Inc("miss")
+	}
 
-	err := rep.storage.StoreBatch(ctx, batch)
+	link, err := rep.load(ctx, id)
+	if err != nil {
+		return "", err
+	}
+	return link.Value, nil
+}
+
+// load reads id from the storage and caches the outcome of the lookup.
+func (rep *Repository) load(ctx context.Context, id string) (storage.Link, error) {
+	defer rep.observe("get", time.Now())
+	if rep.cache == nil {
+		return rep.storage.Get(ctx, id)
+	}
+
+	lookup := rep.cache.begin(id)
+	link, err := rep.storage.Get(ctx, id)
+	rep.cache.finish(lookup, link, err)
+	return link, err
+}
+
+// changeListener is implemented by storages shared between instances that
+// publish changes made by any of them.
+type changeListener interface {
+	Listen(ctx context.Context, onChange func(aliases []string), onReset func())
+}
+
+// ListenForChanges keeps the cache consistent with changes made by other
+// instances sharing the storage until ctx is done. It returns at once if
+// there is no cache or the storage does not publish its changes.
+func (rep *Repository) ListenForChanges(ctx context.Context) {
+	listener, ok := rep.storage.(changeListener)
+	if !ok || rep.cache == nil {
+		return
+	}
+	listener.Listen(ctx, func(aliases []string) { rep.invalidate(aliases...) }, rep.cache.flush)
+}
+
+// invalidate drops cached lookups of aliases that have been changed.
+func (rep *Repository) invalidate(aliases ...string) {
+	if rep.cache != nil {
+		rep.cache.invalidate(aliases...)
+	}
+}
+
+func (rep *Repository) GetByUserID(ctx context.Context, userID string) ([]dto.UserURL, error) {
+	defer rep.observe("get_by_user", time.Now())
+	return rep.storage.GetByUserID(ctx, userID)
+}
+
+func (rep *Repository) DeleteBatch(ctx context.Context, userID string, aliases []string) error {
+	defer rep.observe("delete_batch", time.Now())
+	rep.dumpM.RLock()
+	defer rep.dumpM.RUnlock()
+	err := rep.storage.DeleteBatch(ctx, userID, aliases)
 	if err != nil {
 		return err
 	}
+	rep.invalidate(aliases...)
 
-	if rep.encoder != nil {
-		for _, entry := range batch {
-			if err := rep.storeToFile(entry.ID, entry.URL); err != nil {
+	if rep.wal != nil {
+		for _, alias := range aliases {
+			if err := rep.appendRow(row{ShortURL: alias, UserID: userID, Deleted: true}); err != nil {
 				return err
 			}
 		}
 	}
-
 	return nil
 }
 
-func (rep *Repository) Get(ctx context.Context, id string) (string, error) {
-	return rep.storage.Get(ctx, id)
+func (rep *Repository) PurgeExpired(ctx context.Context) (int, error) {
+	defer rep.observe("purge_expired", time.Now())
+	return rep.storage.PurgeExpired(ctx)
+}
+
+func (rep *Repository) StoreClicks(ctx context.Context, clicks []dto.Click) error {
+	defer rep.observe("store_clicks", time.Now())
+	return rep.storage.StoreClicks(ctx, clicks)
+}
+
+func (rep *Repository) GetOwner(ctx context.Context, id string) (string, error) {
+	defer rep.observe("get_owner", time.Now())
+	return rep.storage.GetOwner(ctx, id)
+}
+
+func (rep *Repository) ClickStats(ctx context.Context, alias string, from, to time.Time, top int) (dto.LinkStats, error) {
+	defer rep.observe("click_stats", time.Now())
+	return rep.storage.ClickStats(ctx, alias, from, to, top)
+}
+
+// ReserveResponse reserves an idempotency key or returns what is kept
+// under it. Responses are not written to the dump file.
+func (rep *Repository) ReserveResponse(ctx context.Context, key, requestHash string, expiresAt time.Time) (dto.IdempotentResponse, bool, error) {
+	defer rep.observe("reserve_response", time.Now())
+	return rep.storage.ReserveResponse(ctx, key, requestHash, expiresAt)
+}
+
+func (rep *Repository) SaveResponse(ctx context.Context, key string, resp dto.IdempotentResponse, expiresAt time.Time) error {
+	defer rep.observe("save_response", time.Now())
+	return rep.storage.SaveResponse(ctx, key, resp, expiresAt)
+}
+
+func (rep *Repository) ReleaseResponse(ctx context.Context, key string) error {
+	defer rep.observe("release_response", time.Now())
+	return rep.storage.ReleaseResponse(ctx, key)
+}
+
+// PoolStats reports connection pool statistics if the storage is backed
+// by a connection pool.
+func (rep *Repository) PoolStats() (dto.PoolStats, bool) {
+	pooled, ok := rep.storage.(interface{ PoolStats() dto.PoolStats })
+	if !ok {
+		return dto.PoolStats{}, false
+	}
+	return pooled.PoolStats(), true
+}
+
+// MemoryStats reports memory usage if the storage keeps links in memory.
+func (rep *Repository) MemoryStats() (dto.MemoryStats, bool) {
+	mem, ok := rep.storage.(interface{ Stats() dto.MemoryStats })
+	if !ok {
+		return dto.MemoryStats{}, false
+	}
+	return mem.Stats(), true
 }
 
 func (rep *Repository) PingDB(ctx context.Context) error {
@@ -155,13 +483,54 @@ func (rep *Repository) Close(ctx context.Context) error {
 	if err != nil {
 		return err
 	}
-	if rep.file != nil {
-		return rep.file.Close()
+	// A running compaction is let finish.
+	rep.compactM.Lock()
+	defer rep.compactM.Unlock()
+	if rep.wal != nil {
+		return rep.wal.Close()
 	}
 	return nil
 }
 
-func (rep *Repository) storeToFile(id, value string) error {
-	r := row{ShortURL: id, LongURL: value}
-	return rep.encoder.Encode(r)
+func (rep *Repository) observe(operation string, start time.Time) {
+	metrics.StorageOperationDuration.Observe(time.Since(start).Seconds(), rep.backend, operation)
+}
+
+// evicted is called by the in-memory storage for every link it evicts.
+// Evicted links are optionally spilled to the dump file, so that they are
+// recovered along with the rest of it. It runs within a write, which holds
+// dumpM already.
+func (rep *Repository) evicted(id string, link memorystorage.Evicted) {
+	metrics.Evictions.Inc()
+	rep.invalidate(id)
+	if !rep.spillEvicted || rep.wal == nil || rep.restoring {
+		return
+	}
+	r := row{
+		ShortURL:  id,
+		LongURL:   link.Value,
+		UserID:    link.UserID,
+		Deleted:   link.Deleted,
+		ExpiresAt: link.ExpiresAt,
+		Evicted:   true,
+	}
+	if err := rep.appendRow(r); err != nil {
+		rep.log.Errorf("failed to spill evicted url %q: %s", id, err)
+	}
+}
+
+func (rep *Repository) storeToFile(id, value, userID string, expiresAt *time.Time) error {
+	r := row{ShortURL: id, LongURL: value, UserID: userID, ExpiresAt: expiresAt}
+	return rep.appendRow(r)
+}
+
+func (rep *Repository) appendRow(r row) error {
+	data, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	if rep.keys != nil {
+		return rep.sealRow(data)
+	}
+	return rep.wal.Append(data)
 }
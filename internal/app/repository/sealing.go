@@ -0,0 +1,113 @@
+package repository
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"github.com/DeneesK/short-url/internal/app/keyring"
+)
+
+// ErrDumpTampered is returned when restoring a dump file whose encrypted
+// rows have been altered or moved.
+var ErrDumpTampered = errors.New("dump file is tampered with")
+
+// An encrypted dump segment is a run of sealed rows that follows a segment
+// header. The header carries a random segment id, and every row is sealed
+// together with that id and its position in the run, so that rows cannot
+// be dropped from the middle of a run, reordered or moved to another one.
+// A run starts whenever a dump segment is first written to after it is
+// opened.
+const (
+	segmentMagic  = "\x02SEG"
+	segmentIDSize = 16
+)
+
+func newSegmentHeader() (header, id []byte) {
+	header = make([]byte, len(segmentMagic)+segmentIDSize)
+	copy(header, segmentMagic)
+	id = header[len(segmentMagic):]
+	if _, err := rand.Read(id); err != nil {
+		panic(fmt.Sprintf("repository: failed to generate segment id: %v", err))
+	}
+	return header, id
+}
+
+// parseSegmentHeader returns the segment id of a dump record that is a
+// segment header.
+func parseSegmentHeader(data []byte) ([]byte, bool) {
+	if len(data) != len(segmentMagic)+segmentIDSize || !bytes.HasPrefix(data, []byte(segmentMagic)) {
+		return nil, false
+	}
+	return data[len(segmentMagic):], true
+}
+
+// segmentAD is the additional data the seq-th row of segment is sealed with.
+func segmentAD(segment []byte, seq uint64) []byte {
+	return binary.BigEndian.AppendUint64(append([]byte(nil), segment...), seq)
+}
+
+// sealRow appends data to the dump as the next row of the current segment,
+// starting the segment if needed.
+func (rep *Repository) sealRow(data []byte) error {
+	rep.appendM.Lock()
+	defer rep.appendM.Unlock()
+	if rep.segment == nil {
+		header, id := newSegmentHeader()
+		if err := rep.wal.Append(header); err != nil {
+			return err
+		}
+		rep.segment, rep.seq = id, 0
+	}
+	if err := rep.wal.Append(rep.keys.Seal(data, segmentAD(rep.segment, rep.seq))); err != nil {
+		return err
+	}
+	rep.seq++
+	return nil
+}
+
+// openRow returns the JSON of the seq-th row of segment, which is nil for
+// rows written before the dump was encrypted. A restore that comes across
+// rows in plain text or sealed under an older key notes that the dump is
+// to be sealed again.
+func (rep *Repository) openRow(data, segment []byte, seq uint64) ([]byte, error) {
+	if !keyring.IsSealed(data) {
+		if segment != nil {
+			return nil, fmt.Errorf("%w: plain row in an encrypted segment", ErrDumpTampered)
+		}
+		rep.reseal = rep.reseal || rep.restoring && rep.keys != nil
+		return data, nil
+	}
+	if rep.keys == nil {
+		return nil, ErrDumpEncrypted
+	}
+	if segment == nil {
+		return nil, fmt.Errorf("%w: sealed row outside of a segment", ErrDumpTampered)
+	}
+	rep.reseal = rep.reseal || rep.restoring && !rep.keys.IsCurrent(data)
+	data, err := rep.keys.Open(data, segmentAD(segment, seq))
+	if err != nil && !errors.Is(err, keyring.ErrUnknownKey) {
+		return nil, fmt.Errorf("%w: row %d of a segment: %v", ErrDumpTampered, seq, err)
+	}
+	return data, err
+}
+
+// restoreCipher opens a snapshot and notes whether it is sealed, and
+// whether under the current key.
+type restoreCipher struct {
+	keys   *keyring.Keyring
+	sealed bool
+	stale  bool
+}
+
+func (c *restoreCipher) Seal(plaintext, additionalData []byte) []byte {
+	return c.keys.Seal(plaintext, additionalData)
+}
+
+func (c *restoreCipher) Open(sealed, additionalData []byte) ([]byte, error) {
+	c.sealed = true
+	c.stale = c.stale || !c.keys.IsCurrent(sealed)
+	return c.keys.Open(sealed, additionalData)
+}
@@ -2,17 +2,26 @@ package router
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
+	"strconv"
+	"time"
 
 	"github.com/DeneesK/short-url/internal/app/dto"
+	"github.com/DeneesK/short-url/internal/app/metrics"
 	"github.com/DeneesK/short-url/internal/app/service"
+	"github.com/DeneesK/short-url/internal/app/storage"
+	"github.com/DeneesK/short-url/pkg/clientip"
 	"github.com/go-chi/chi/v5"
 )
 
 type LongURL struct {
-	URL string `json:"url"`
+	URL        string     `json:"url"`
+	Alias      string     `json:"alias,omitempty"`
+	ExpiresAt  *time.Time `json:"expires_at,omitempty"`
+	TTLSeconds int64      `json:"ttl_seconds,omitempty"`
 }
 
 type ShortURL struct {
@@ -31,8 +40,11 @@ func URLShortener(urlService URLService, log Logger) http.HandlerFunc {
 
 		longURL := string(body)
 
-		shortURL, err := urlService.ShortenURL(r.Context(), longURL)
-		if err != nil && err != service.ErrLongURLAlreadyExists {
+		shortURL, err := urlService.ShortenURL(r.Context(), longURL, dto.ShortenOptions{Alias: r.URL.Query().Get("alias")})
+		if errors.Is(err, service.ErrAliasAlreadyTaken) {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		} else if err != nil && err != service.ErrLongURLAlreadyExists {
 			errorString := fmt.Sprintf("failed to create short url: %s", err.Error())
 			log.Error(errorString)
 			http.Error(w, errorString, http.StatusBadRequest)
@@ -59,8 +71,16 @@ func URLShortenerJSON(urlService URLService, log Logger) http.HandlerFunc {
 			return
 		}
 
-		shortURL, err := urlService.ShortenURL(r.Context(), longURL.URL)
-		if err != nil && err != service.ErrLongURLAlreadyExists {
+		opts := dto.ShortenOptions{
+			Alias:      longURL.Alias,
+			ExpiresAt:  longURL.ExpiresAt,
+			TTLSeconds: longURL.TTLSeconds,
+		}
+		shortURL, err := urlService.ShortenURL(r.Context(), longURL.URL, opts)
+		if errors.Is(err, service.ErrAliasAlreadyTaken) {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		} else if err != nil && err != service.ErrLongURLAlreadyExists {
 			errorString := fmt.Sprintf("failed to create short url: %s", err.Error())
 			log.Error(errorString)
 			http.Error(w, errorString, http.StatusBadRequest)
@@ -95,13 +115,27 @@ func URLRedirect(urlService URLService, log Logger) http.HandlerFunc {
 		}
 
 		url, err := urlService.FindByShortened(r.Context(), id)
-		if err != nil {
+		if errors.Is(err, service.ErrURLDeleted) || errors.Is(err, service.ErrURLExpired) {
+			metrics.Redirects.Inc("gone")
+			http.Error(w, err.Error(), http.StatusGone)
+			return
+		} else if err != nil {
+			metrics.Redirects.Inc("miss")
 			errorString := fmt.Sprintf("failed to redirect: %s", err.Error())
 			log.Error(errorString)
 			http.Error(w, errorString, http.StatusBadRequest)
 			return
 		}
 
+		metrics.Redirects.Inc("hit")
+		urlService.RecordClick(dto.Click{
+			Alias:     id,
+			ClickedAt: time.Now(),
+			Referrer:  r.Referer(),
+			UserAgent: r.UserAgent(),
+			IP:        clientip.Anonymize(clientip.FromRequest(r)),
+		})
+
 		w.Header().Set("Location", url)
 		http.Redirect(w, r, url, http.StatusTemporaryRedirect)
 	}
@@ -118,8 +152,23 @@ func URLShortenerBatchJSON(urlService URLService, log Logger) http.HandlerFunc {
 			return
 		}
 
-		result, err := urlService.StoreBatchURL(r.Context(), batch)
-		if err != nil {
+		var opts dto.BatchOptions
+		if atomic := r.URL.Query().Get("atomic"); atomic != "" {
+			opts.Atomic, err = strconv.ParseBool(atomic)
+			if err != nil {
+				http.Error(w, "failed to parse 'atomic' parameter", http.StatusBadRequest)
+				return
+			}
+		}
+
+		result, err := urlService.StoreBatchURL(r.Context(), batch, opts)
+		if errors.Is(err, service.ErrAliasAlreadyTaken) {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		} else if errors.Is(err, service.ErrAliasNotAllowed) {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		} else if err != nil {
 			errorString := fmt.Sprintf("failed to create short url: %s", err.Error())
 			log.Error(errorString)
 			http.Error(w, errorString, http.StatusBadRequest)
@@ -127,7 +176,7 @@ func URLShortenerBatchJSON(urlService URLService, log Logger) http.HandlerFunc {
 		}
 
 		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusCreated)
+		w.WriteHeader(batchStatus(result))
 
 		err = json.NewEncoder(w).Encode(result)
 		if err != nil {
@@ -139,6 +188,159 @@ func URLShortenerBatchJSON(urlService URLService, log Logger) http.HandlerFunc {
 	}
 }
 
+// batchStatus returns 207 Multi-Status if any item of the batch has been
+// rejected and 201 otherwise.
+func batchStatus(result []dto.ShortedURL) int {
+	for _, item := range result {
+		if item.Status == dto.StatusInvalid {
+			return http.StatusMultiStatus
+		}
+	}
+	return http.StatusCreated
+}
+
+func UserURLs(urlService URLService, log Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		urls, err := urlService.FindByUser(r.Context())
+		if errors.Is(err, service.ErrUnauthorized) {
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		} else if err != nil {
+			log.Errorf("failed to get user's urls: %s", err)
+			http.Error(w, "failed to get user's urls", http.StatusInternalServerError)
+			return
+		}
+
+		if len(urls) == 0 {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+
+		err = json.NewEncoder(w).Encode(urls)
+		if err != nil {
+			log.Errorf("failed to encode user's urls: %s", err)
+		}
+	}
+}
+
+func DeleteUserURLs(urlService URLService, log Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		aliases := make([]string, 0)
+
+		err := json.NewDecoder(r.Body).Decode(&aliases)
+		if err != nil {
+			log.Errorf("failed to decode request's body %s", err)
+			http.Error(w, "failed to decode request's body", http.StatusBadRequest)
+			return
+		}
+
+		err = urlService.DeleteUserURLs(r.Context(), aliases)
+		if errors.Is(err, service.ErrUnauthorized) {
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		} else if err != nil {
+			log.Errorf("failed to schedule urls deletion: %s", err)
+			http.Error(w, "failed to delete urls", http.StatusInternalServerError)
+			return
+		}
+
+		w.WriteHeader(http.StatusAccepted)
+	}
+}
+
+func LinkStats(urlService URLService, log Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := chi.URLParam(r, "id")
+
+		from, err := parseTimeParam(r.URL.Query().Get("from"))
+		if err != nil {
+			http.Error(w, "failed to parse 'from' parameter", http.StatusBadRequest)
+			return
+		}
+		to, err := parseTimeParam(r.URL.Query().Get("to"))
+		if err != nil {
+			http.Error(w, "failed to parse 'to' parameter", http.StatusBadRequest)
+			return
+		}
+
+		stats, err := urlService.Stats(r.Context(), id, from, to)
+		switch {
+		case errors.Is(err, service.ErrUnauthorized):
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		case errors.Is(err, service.ErrForbidden):
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		case errors.Is(err, service.ErrNotFound):
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		case errors.Is(err, service.ErrInvalidRange):
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		case err != nil:
+			log.Errorf("failed to get stats: %s", err)
+			http.Error(w, "failed to get stats", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+
+		err = json.NewEncoder(w).Encode(stats)
+		if err != nil {
+			log.Errorf("failed to encode stats: %s", err)
+		}
+	}
+}
+
+// parseTimeParam accepts either RFC 3339 timestamp or a plain date.
+func parseTimeParam(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	return time.Parse(time.DateOnly, value)
+}
+
+func Diagnostics(urlService URLService, log Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+
+		err := json.NewEncoder(w).Encode(urlService.Diagnostics(r.Context()))
+		if err != nil {
+			log.Errorf("failed to encode diagnostics: %s", err)
+		}
+	}
+}
+
+func CompactDump(compactor Compactor, log Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		result, err := compactor.Compact(r.Context())
+		if errors.Is(err, storage.ErrCompactionUnsupported) {
+			http.Error(w, err.Error(), http.StatusNotImplemented)
+			return
+		} else if err != nil {
+			log.Errorf("failed to compact dump file: %s", err)
+			http.Error(w, "failed to compact dump file", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+
+		err = json.NewEncoder(w).Encode(result)
+		if err != nil {
+			log.Errorf("failed to encode compaction: %s", err)
+		}
+	}
+}
+
 func PingDB(urlService URLService, log Logger) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		err := urlService.PingDB(r.Context())
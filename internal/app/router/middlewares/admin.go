@@ -0,0 +1,43 @@
+package middlewares
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+
+	"github.com/DeneesK/short-url/internal/app/auth"
+)
+
+// NewAdminMiddleware lets through requests bearing token in the
+// Authorization header.
+func NewAdminMiddleware(token string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !hasBearer(r, token) {
+				w.Header().Set("WWW-Authenticate", "Bearer")
+				http.Error(w, "unauthorized", http.StatusUnauthorized)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// NewTrustedClientMiddleware marks requests bearing token in the
+// Authorization header as coming from a trusted client. Other requests
+// are let through as they are.
+func NewTrustedClientMiddleware(token string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if hasBearer(r, token) {
+				r = r.WithContext(auth.WithTrustedClient(r.Context()))
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+func hasBearer(r *http.Request, token string) bool {
+	bearer, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return ok && subtle.ConstantTimeCompare([]byte(bearer), []byte(token)) == 1
+}
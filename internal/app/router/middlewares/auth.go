@@ -0,0 +1,65 @@
+package middlewares
+
+import (
+	"net/http"
+
+	"github.com/DeneesK/short-url/internal/app/auth"
+	"github.com/DeneesK/short-url/pkg/clientip"
+)
+
+const (
+	authCookieName = "user_id"
+	cookieMaxAge   = 60 * 60 * 24 * 365
+)
+
+type authConfig struct {
+	issueLimiter *RateLimiter
+}
+
+type AuthOption func(*authConfig)
+
+// WithIssueLimiter limits how many new user IDs a client address gets.
+func WithIssueLimiter(limiter *RateLimiter) AuthOption {
+	return func(c *authConfig) {
+		c.issueLimiter = limiter
+	}
+}
+
+func NewAuthMiddleware(secret string, log Logger, opts ...AuthOption) func(http.Handler) http.Handler {
+	key := []byte(secret)
+	var cfg authConfig
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if cookie, err := r.Cookie(authCookieName); err == nil {
+				if userID, ok := auth.Verify(cookie.Value, key); ok {
+					next.ServeHTTP(w, r.WithContext(auth.WithUserID(r.Context(), userID)))
+					return
+				}
+			}
+
+			if cfg.issueLimiter != nil && !allow(w, cfg.issueLimiter, "ip:"+clientip.FromRequest(r)) {
+				http.Error(w, "too many new users", http.StatusTooManyRequests)
+				return
+			}
+
+			userID, err := auth.NewUserID()
+			if err != nil {
+				log.Errorf("failed to generate user id: %s", err)
+				http.Error(w, "failed to authenticate", http.StatusInternalServerError)
+				return
+			}
+			http.SetCookie(w, &http.Cookie{
+				Name:     authCookieName,
+				Value:    auth.Sign(userID, key),
+				Path:     "/",
+				MaxAge:   cookieMaxAge,
+				HttpOnly: true,
+			})
+
+			next.ServeHTTP(w, r.WithContext(auth.WithIssuedUserID(r.Context(), userID)))
+		})
+	}
+}
@@ -0,0 +1,18 @@
+package middlewares
+
+import (
+	"net/http"
+
+	"github.com/DeneesK/short-url/pkg/clientip"
+)
+
+// NewClientIPMiddleware resolves the client address of every request once,
+// so that clientip.FromRequest returns it further down the chain.
+func NewClientIPMiddleware(resolver *clientip.Resolver) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			addr := resolver.Resolve(r)
+			next.ServeHTTP(w, r.WithContext(clientip.WithAddr(r.Context(), addr)))
+		})
+	}
+}
@@ -0,0 +1,142 @@
+package middlewares
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/DeneesK/short-url/internal/app/auth"
+	"github.com/DeneesK/short-url/internal/app/dto"
+	"github.com/DeneesK/short-url/pkg/clientip"
+)
+
+const (
+	idempotencyKeyHeader = "Idempotency-Key"
+	// inFlightTTL bounds how long a key stays reserved by a request that
+	// never finishes, for example because the instance crashed.
+	inFlightTTL = time.Minute
+)
+
+// IdempotencyStore keeps responses of requests made with an Idempotency-Key.
+type IdempotencyStore interface {
+	// ReserveResponse reserves key for a request in flight, unless a live
+	// record of key exists, which is returned instead.
+	ReserveResponse(ctx context.Context, key, requestHash string, expiresAt time.Time) (dto.IdempotentResponse, bool, error)
+	SaveResponse(ctx context.Context, key string, resp dto.IdempotentResponse, expiresAt time.Time) error
+	ReleaseResponse(ctx context.Context, key string) error
+}
+
+// recordingResponseWriter passes the response through while keeping a copy
+// of its status and body.
+type recordingResponseWriter struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (r *recordingResponseWriter) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	r.body.Write(b)
+	return r.ResponseWriter.Write(b)
+}
+
+func (r *recordingResponseWriter) WriteHeader(statusCode int) {
+	r.status = statusCode
+	r.ResponseWriter.WriteHeader(statusCode)
+}
+
+// NewIdempotencyMiddleware remembers responses of requests carrying an
+// Idempotency-Key header for window and replays them on repeats. Keys are
+// scoped to the client and the path. A key is reserved before the request
+// is handled, so a repeat arriving meanwhile is rejected with 409 instead
+// of being handled twice. A repeat with a different body is rejected with
+// 422. Server errors are not remembered so they can be retried.
+func NewIdempotencyMiddleware(store IdempotencyStore, window time.Duration, log Logger) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			key := r.Header.Get(idempotencyKeyHeader)
+			if key == "" {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			body, err := io.ReadAll(r.Body)
+			if err != nil {
+				http.Error(w, "failed to read request's body", http.StatusBadRequest)
+				return
+			}
+			r.Body = io.NopCloser(bytes.NewReader(body))
+			sum := sha256.Sum256(body)
+			hash := hex.EncodeToString(sum[:])
+
+			client := "ip:" + clientip.FromRequest(r)
+			if auth.IsAuthenticated(r.Context()) {
+				userID, _ := auth.UserIDFromContext(r.Context())
+				client = "user:" + userID
+			}
+			scopedKey := client + ":" + r.URL.Path + ":" + key
+
+			saved, reserved, err := store.ReserveResponse(r.Context(), scopedKey, hash, time.Now().Add(inFlightTTL))
+			if err != nil {
+				log.Errorf("failed to reserve idempotency key: %s", err)
+				http.Error(w, "failed to check idempotency key", http.StatusInternalServerError)
+				return
+			}
+			if !reserved {
+				if saved.RequestHash != hash {
+					http.Error(w, "idempotency key has been used with a different request", http.StatusUnprocessableEntity)
+					return
+				}
+				if saved.InFlight() {
+					w.Header().Set("Retry-After", "1")
+					http.Error(w, "a request with this idempotency key is in progress", http.StatusConflict)
+					return
+				}
+				if saved.ContentType != "" {
+					w.Header().Set("Content-Type", saved.ContentType)
+				}
+				w.Header().Set("Idempotent-Replayed", "true")
+				w.WriteHeader(saved.StatusCode)
+				w.Write(saved.Body)
+				return
+			}
+
+			kept := false
+			defer func() {
+				if kept {
+					return
+				}
+				// Unless a response is kept, the request may be retried, also
+				// if the handler panicked or the client went away.
+				if err := store.ReleaseResponse(context.WithoutCancel(r.Context()), scopedKey); err != nil {
+					log.Errorf("failed to release idempotency key: %s", err)
+				}
+			}()
+
+			rec := &recordingResponseWriter{ResponseWriter: w}
+			next.ServeHTTP(rec, r)
+			if rec.status == 0 || rec.status >= http.StatusInternalServerError {
+				return
+			}
+
+			resp := dto.IdempotentResponse{
+				RequestHash: hash,
+				StatusCode:  rec.status,
+				ContentType: rec.Header().Get("Content-Type"),
+				Body:        rec.body.Bytes(),
+			}
+			err = store.SaveResponse(context.WithoutCancel(r.Context()), scopedKey, resp, time.Now().Add(window))
+			if err != nil {
+				log.Errorf("failed to save idempotent response: %s", err)
+				return
+			}
+			kept = true
+		})
+	}
+}
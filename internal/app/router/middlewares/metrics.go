@@ -0,0 +1,40 @@
+package middlewares
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/DeneesK/short-url/internal/app/metrics"
+	"github.com/go-chi/chi/v5"
+)
+
+const unmatchedRoute = "unmatched"
+
+func NewMetricsMiddleware() func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			start := time.Now()
+
+			responseData := &responseData{}
+			lw := loggingResponseWriter{
+				ResponseWriter: w,
+				responseData:   responseData,
+			}
+			next.ServeHTTP(&lw, r)
+
+			route := unmatchedRoute
+			if rctx := chi.RouteContext(r.Context()); rctx != nil && rctx.RoutePattern() != "" {
+				route = rctx.RoutePattern()
+			}
+			status := responseData.status
+			if status == 0 {
+				status = http.StatusOK
+			}
+
+			labels := []string{route, r.Method, strconv.Itoa(status)}
+			metrics.HTTPRequests.Inc(labels...)
+			metrics.HTTPRequestDuration.Observe(time.Since(start).Seconds(), labels...)
+		})
+	}
+}
@@ -0,0 +1,123 @@
+package middlewares
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/DeneesK/short-url/internal/app/auth"
+	"github.com/DeneesK/short-url/pkg/clientip"
+)
+
+const minIdleTTL = time.Minute
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// RateLimiter keeps a token bucket per client. A bucket idle for longer
+// than it takes to refill completely is indistinguishable from a new one,
+// so such buckets are evicted.
+type RateLimiter struct {
+	m         sync.Mutex
+	rate      float64
+	burst     float64
+	idleTTL   time.Duration
+	buckets   map[string]*bucket
+	lastSweep time.Time
+}
+
+// NewRateLimiter allows rate requests per second on average and up to
+// burst requests at once.
+func NewRateLimiter(rate float64, burst int) *RateLimiter {
+	idleTTL := time.Duration(float64(burst) / rate * float64(time.Second))
+	if idleTTL < minIdleTTL {
+		idleTTL = minIdleTTL
+	}
+	return &RateLimiter{
+		rate:      rate,
+		burst:     float64(burst),
+		idleTTL:   idleTTL,
+		buckets:   make(map[string]*bucket),
+		lastSweep: time.Now(),
+	}
+}
+
+// Allow takes a token from key's bucket. It returns whether the request
+// is allowed, the number of tokens left, how long to wait for the next
+// token and how long until the bucket is full again.
+func (l *RateLimiter) Allow(key string) (bool, int, time.Duration, time.Duration) {
+	l.m.Lock()
+	defer l.m.Unlock()
+
+	now := time.Now()
+	if now.Sub(l.lastSweep) > l.idleTTL {
+		l.sweep(now)
+	}
+
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{tokens: l.burst, last: now}
+		l.buckets[key] = b
+	}
+	b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+	b.last = now
+
+	if b.tokens < 1 {
+		return false, 0, l.refillTime(1 - b.tokens), l.refillTime(l.burst - b.tokens)
+	}
+	b.tokens--
+	return true, int(b.tokens), 0, l.refillTime(l.burst - b.tokens)
+}
+
+func (l *RateLimiter) refillTime(tokens float64) time.Duration {
+	return time.Duration(tokens / l.rate * float64(time.Second))
+}
+
+func (l *RateLimiter) sweep(now time.Time) {
+	for key, b := range l.buckets {
+		if now.Sub(b.last) > l.idleTTL {
+			delete(l.buckets, key)
+		}
+	}
+	l.lastSweep = now
+}
+
+// NewRateLimitMiddleware limits requests of authenticated users by their
+// ID and of anonymous clients by their address. Users cannot multiply
+// their buckets by dropping their cookie as long as getting a new one is
+// limited by address too, see WithIssueLimiter.
+func NewRateLimitMiddleware(limiter *RateLimiter) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			key := "ip:" + clientip.FromRequest(r)
+			if auth.IsAuthenticated(r.Context()) {
+				userID, _ := auth.UserIDFromContext(r.Context())
+				key = "user:" + userID
+			}
+
+			if !allow(w, limiter, key) {
+				http.Error(w, "too many requests", http.StatusTooManyRequests)
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// allow takes a token of key's bucket and reports the state of the bucket
+// in the response headers.
+func allow(w http.ResponseWriter, limiter *RateLimiter, key string) bool {
+	allowed, remaining, wait, reset := limiter.Allow(key)
+	w.Header().Set("X-RateLimit-Limit", strconv.Itoa(int(limiter.burst)))
+	w.Header().Set("X-RateLimit-Remaining", strconv.Itoa(remaining))
+	w.Header().Set("X-RateLimit-Reset", strconv.Itoa(int(math.Ceil(reset.Seconds()))))
+	if !allowed {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	}
+	return allowed
+}
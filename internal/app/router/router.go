@@ -2,38 +2,183 @@ package router
 
 import (
 	"context"
+	"time"
 
 	"github.com/DeneesK/short-url/internal/app/dto"
+	"github.com/DeneesK/short-url/internal/app/metrics"
 	"github.com/DeneesK/short-url/internal/app/router/middlewares"
+	"github.com/DeneesK/short-url/pkg/clientip"
 	"github.com/go-chi/chi/v5"
 )
 
 type URLService interface {
-	ShortenURL(context.Context, string) (string, error)
-	StoreBatchURL(context.Context, []dto.OriginalURL) ([]dto.ShortedURL, error)
+	ShortenURL(context.Context, string, dto.ShortenOptions) (string, error)
+	StoreBatchURL(context.Context, []dto.OriginalURL, dto.BatchOptions) ([]dto.ShortedURL, error)
 	FindByShortened(context.Context, string) (string, error)
+	FindByUser(context.Context) ([]dto.UserURL, error)
+	DeleteUserURLs(context.Context, []string) error
+	RecordClick(dto.Click)
+	Stats(ctx context.Context, alias string, from, to time.Time) (dto.LinkStats, error)
+	Diagnostics(context.Context) dto.Diagnostics
 	PingDB(context.Context) error
 }
 
+// Compactor compacts the dump file on demand.
+type Compactor interface {
+	Compact(context.Context) (dto.Compaction, error)
+}
+
 type Logger interface {
 	Infoln(args ...interface{})
 	Errorf(template string, args ...interface{})
 	Error(args ...interface{})
 }
 
-func NewRouter(service URLService, log Logger) *chi.Mux {
+type config struct {
+	shortenLimiter     *middlewares.RateLimiter
+	redirectLimiter    *middlewares.RateLimiter
+	issueLimiter       *middlewares.RateLimiter
+	idempotencyStore   middlewares.IdempotencyStore
+	idempotencyWindow  time.Duration
+	compactor          Compactor
+	adminToken         string
+	trustedClientToken string
+	clientIP           *clientip.Resolver
+}
+
+type Option func(*config)
+
+// WithShortenRateLimit limits requests to shortening endpoints per client.
+func WithShortenRateLimit(rate float64, burst int) Option {
+	return func(c *config) {
+		if rate > 0 && burst > 0 {
+			c.shortenLimiter = middlewares.NewRateLimiter(rate, burst)
+		}
+	}
+}
+
+// WithRedirectRateLimit limits redirect requests per client.
+func WithRedirectRateLimit(rate float64, burst int) Option {
+	return func(c *config) {
+		if rate > 0 && burst > 0 {
+			c.redirectLimiter = middlewares.NewRateLimiter(rate, burst)
+		}
+	}
+}
+
+// WithIssueRateLimit limits how many new user IDs are issued per client
+// address on routes that act on behalf of a user, so that clients cannot
+// dodge per-user limits by dropping their cookie. Redirects and the other
+// routes keep issuing IDs without a limit.
+func WithIssueRateLimit(rate float64, burst int) Option {
+	return func(c *config) {
+		if rate > 0 && burst > 0 {
+			c.issueLimiter = middlewares.NewRateLimiter(rate, burst)
+		}
+	}
+}
+
+// WithIdempotency honours the Idempotency-Key header on JSON shortening
+// endpoints, remembering responses in store for window.
+func WithIdempotency(store middlewares.IdempotencyStore, window time.Duration) Option {
+	return func(c *config) {
+		if store != nil && window > 0 {
+			c.idempotencyStore = store
+			c.idempotencyWindow = window
+		}
+	}
+}
+
+// WithTrustedProxies resolves client addresses with resolver, which may
+// believe forwarding headers of trusted proxies. By default the address
+// of the connection's peer is used.
+func WithTrustedProxies(resolver *clientip.Resolver) Option {
+	return func(c *config) {
+		if resolver != nil {
+			c.clientIP = resolver
+		}
+	}
+}
+
+// WithAdmin serves admin endpoints to requests bearing token. An empty
+// token leaves them out.
+func WithAdmin(compactor Compactor, token string) Option {
+	return func(c *config) {
+		if token != "" {
+			c.compactor = compactor
+			c.adminToken = token
+		}
+	}
+}
+
+// WithTrustedClients lets requests bearing token ask for specific aliases
+// in batches. An empty token lets no one.
+func WithTrustedClients(token string) Option {
+	return func(c *config) {
+		c.trustedClientToken = token
+	}
+}
+
+func NewRouter(service URLService, log Logger, secretKey string, opts ...Option) *chi.Mux {
+	cfg := config{clientIP: &clientip.Resolver{}}
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+
 	r := chi.NewRouter()
 
+	metricsMiddleware := middlewares.NewMetricsMiddleware()
 	loggingMiddleware := middlewares.NewLoggingMiddleware(log)
 	gzipReqDecodeMiddleware := middlewares.NewRequestDecodeMiddleware(log)
 	gzipRespEncodeMiddleware := middlewares.NewResponseEncodeMiddleware(log)
-	r.Use(loggingMiddleware, gzipReqDecodeMiddleware, gzipRespEncodeMiddleware)
+	authMiddleware := middlewares.NewAuthMiddleware(secretKey, log)
+	userAuthMiddleware := authMiddleware
+	if cfg.issueLimiter != nil {
+		userAuthMiddleware = middlewares.NewAuthMiddleware(secretKey, log, middlewares.WithIssueLimiter(cfg.issueLimiter))
+	}
+	clientIPMiddleware := middlewares.NewClientIPMiddleware(cfg.clientIP)
+	r.Use(clientIPMiddleware, metricsMiddleware, loggingMiddleware, gzipReqDecodeMiddleware, gzipRespEncodeMiddleware)
 
-	r.Post("/", URLShortener(service, log))
-	r.Post("/api/shorten/batch", URLShortenerBatchJSON(service, log))
-	r.Post("/api/shorten", URLShortenerJSON(service, log))
-	r.Get("/{id}", URLRedirect(service, log))
-	r.Get("/ping", PingDB(service, log))
+	r.Group(func(r chi.Router) {
+		r.Use(userAuthMiddleware)
+		r.Group(func(r chi.Router) {
+			if cfg.shortenLimiter != nil {
+				r.Use(middlewares.NewRateLimitMiddleware(cfg.shortenLimiter))
+			}
+			if cfg.trustedClientToken != "" {
+				r.Use(middlewares.NewTrustedClientMiddleware(cfg.trustedClientToken))
+			}
+			r.Post("/", URLShortener(service, log))
+			r.Group(func(r chi.Router) {
+				if cfg.idempotencyStore != nil {
+					r.Use(middlewares.NewIdempotencyMiddleware(cfg.idempotencyStore, cfg.idempotencyWindow, log))
+				}
+				r.Post("/api/shorten/batch", URLShortenerBatchJSON(service, log))
+				r.Post("/api/shorten", URLShortenerJSON(service, log))
+			})
+		})
+		r.Get("/api/user/urls", UserURLs(service, log))
+		r.Delete("/api/user/urls", DeleteUserURLs(service, log))
+		r.Get("/api/stats/{id}", LinkStats(service, log))
+	})
+	r.Group(func(r chi.Router) {
+		r.Use(authMiddleware)
+		r.Group(func(r chi.Router) {
+			if cfg.redirectLimiter != nil {
+				r.Use(middlewares.NewRateLimitMiddleware(cfg.redirectLimiter))
+			}
+			r.Get("/{id}", URLRedirect(service, log))
+		})
+		r.Get("/ping", PingDB(service, log))
+		r.Get("/metrics", metrics.Handler().ServeHTTP)
+		if cfg.adminToken != "" {
+			r.Group(func(r chi.Router) {
+				r.Use(middlewares.NewAdminMiddleware(cfg.adminToken))
+				r.Get("/api/diagnostics", Diagnostics(service, log))
+				r.Post("/api/admin/compact", CompactDump(cfg.compactor, log))
+			})
+		}
+	})
 
 	return r
 }
@@ -0,0 +1,103 @@
+package service
+
+import (
+	"sync"
+
+	"github.com/DeneesK/short-url/internal/app/dto"
+	"github.com/DeneesK/short-url/internal/app/metrics"
+)
+
+const (
+	collisionWindow = 100
+	// collisionThreshold is the number of collisions within a window that
+	// makes the keyspace considered crowded.
+	collisionThreshold = collisionWindow / 4
+	maxAliasLength     = 64
+)
+
+// aliasPolicy tracks collisions of generated aliases and switches the
+// generator to longer aliases once they become frequent.
+type aliasPolicy struct {
+	m                sync.Mutex
+	generator        AliasGenerator
+	attempts         uint64
+	collisions       uint64
+	resizes          uint64
+	windowAttempts   int
+	windowCollisions int
+}
+
+func newAliasPolicy(generator AliasGenerator) *aliasPolicy {
+	return &aliasPolicy{generator: generator}
+}
+
+func (p *aliasPolicy) generate(longURL string, attempt int) string {
+	p.m.Lock()
+	g := p.generator
+	p.m.Unlock()
+	return g.Generate(longURL, attempt)
+}
+
+// observe records the outcome of storing a generated alias.
+func (p *aliasPolicy) observe(collided bool) {
+	p.m.Lock()
+	defer p.m.Unlock()
+
+	p.attempts++
+	p.windowAttempts++
+	if collided {
+		metrics.AliasCollisions.Inc()
+		p.collisions++
+		p.windowCollisions++
+	}
+
+	switch {
+	case p.windowCollisions >= collisionThreshold:
+		p.grow()
+		p.resetWindow()
+	case p.windowAttempts >= collisionWindow:
+		p.resetWindow()
+	}
+}
+
+// exhausted is called when every retry of a single request collided,
+// which means the keyspace is crowded regardless of the window statistics.
+func (p *aliasPolicy) exhausted() {
+	p.m.Lock()
+	defer p.m.Unlock()
+
+	p.grow()
+	p.resetWindow()
+}
+
+func (p *aliasPolicy) grow() {
+	length := p.generator.Length() + 1
+	if length > maxAliasLength {
+		return
+	}
+	g, err := p.generator.WithLength(length)
+	if err != nil {
+		return
+	}
+	p.generator = g
+	p.resizes++
+}
+
+func (p *aliasPolicy) resetWindow() {
+	p.windowAttempts = 0
+	p.windowCollisions = 0
+}
+
+func (p *aliasPolicy) diagnostics() dto.AliasDiagnostics {
+	p.m.Lock()
+	defer p.m.Unlock()
+
+	return dto.AliasDiagnostics{
+		Length:           p.generator.Length(),
+		Attempts:         p.attempts,
+		Collisions:       p.collisions,
+		Resizes:          p.resizes,
+		WindowAttempts:   p.windowAttempts,
+		WindowCollisions: p.windowCollisions,
+	}
+}
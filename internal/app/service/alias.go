@@ -0,0 +1,175 @@
+package service
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"math/bits"
+	"math/rand/v2"
+	"strconv"
+	"sync/atomic"
+
+	"github.com/DeneesK/short-url/pkg/random"
+)
+
+const (
+	StrategyRandom  = "random"
+	StrategyBase62  = "base62"
+	StrategyCounter = "counter"
+	StrategyHash    = "hash"
+
+	// maxCounterLength keeps 62^length within uint64.
+	maxCounterLength = 10
+	// permutationMultiplier is coprime with 62, so multiplying by it is a
+	// bijection modulo any power of 62.
+	permutationMultiplier = 0x5DEECE66D
+)
+
+// AliasGenerator produces candidate aliases for longURL. attempt starts
+// at zero and grows on every retry after a collision.
+type AliasGenerator interface {
+	Generate(longURL string, attempt int) string
+	Length() int
+	// WithLength returns a generator of the same strategy producing
+	// aliases of the given length.
+	WithLength(length int) (AliasGenerator, error)
+}
+
+func NewAliasGenerator(strategy string, length int) (AliasGenerator, error) {
+	if length <= 0 {
+		return nil, fmt.Errorf("alias length must be positive, got %d", length)
+	}
+	switch strategy {
+	case StrategyRandom, "":
+		return randomGenerator{length: length}, nil
+	case StrategyBase62:
+		return base62Generator{length: length}, nil
+	case StrategyCounter:
+		return newCounterGenerator(length)
+	case StrategyHash:
+		return hashGenerator{length: length}, nil
+	}
+	return nil, fmt.Errorf("unknown alias strategy %q", strategy)
+}
+
+// randomGenerator keeps the original behaviour: random latin letters.
+type randomGenerator struct {
+	length int
+}
+
+func (g randomGenerator) Generate(string, int) string {
+	return random.RandomString(g.length)
+}
+
+func (g randomGenerator) Length() int {
+	return g.length
+}
+
+func (g randomGenerator) WithLength(length int) (AliasGenerator, error) {
+	return NewAliasGenerator(StrategyRandom, length)
+}
+
+type base62Generator struct {
+	length int
+}
+
+func (g base62Generator) Generate(string, int) string {
+	return random.StringFrom(random.Base62, g.length)
+}
+
+func (g base62Generator) Length() int {
+	return g.length
+}
+
+func (g base62Generator) WithLength(length int) (AliasGenerator, error) {
+	return NewAliasGenerator(StrategyBase62, length)
+}
+
+// counterGenerator encodes a monotonically increasing counter. The counter
+// is passed through an affine permutation modulo 62^length so consecutive
+// aliases do not look consecutive, yet never repeat within the keyspace
+// while the process runs. Neither the counter nor the permutation is
+// persisted, so aliases issued by other processes, earlier runs included,
+// may come up again; those collisions are retried like any other.
+type counterGenerator struct {
+	length  int
+	modulus uint64
+	offset  uint64
+	counter atomic.Uint64
+}
+
+func newCounterGenerator(length int) (*counterGenerator, error) {
+	if length > maxCounterLength {
+		return nil, fmt.Errorf("counter alias length must not exceed %d, got %d", maxCounterLength, length)
+	}
+	modulus := uint64(1)
+	for i := 0; i < length; i++ {
+		modulus *= uint64(len(random.Base62))
+	}
+	g := &counterGenerator{
+		length:  length,
+		modulus: modulus,
+		offset:  rand.Uint64N(modulus),
+	}
+	g.counter.Store(rand.Uint64N(modulus))
+	return g, nil
+}
+
+func (g *counterGenerator) Generate(string, int) string {
+	n := g.counter.Add(1) % g.modulus
+	return encodeBase62(g.permute(n), g.length)
+}
+
+func (g *counterGenerator) Length() int {
+	return g.length
+}
+
+func (g *counterGenerator) WithLength(length int) (AliasGenerator, error) {
+	return NewAliasGenerator(StrategyCounter, length)
+}
+
+func (g *counterGenerator) permute(n uint64) uint64 {
+	hi, lo := bits.Mul64(permutationMultiplier%g.modulus, n)
+	_, rem := bits.Div64(hi, lo, g.modulus)
+	return (rem + g.offset) % g.modulus
+}
+
+// hashGenerator derives the alias from the long URL, so the same URL
+// always gets the same candidate. attempt is mixed in to resolve collisions.
+type hashGenerator struct {
+	length int
+}
+
+func (g hashGenerator) Generate(longURL string, attempt int) string {
+	input := longURL
+	if attempt > 0 {
+		input += "#" + strconv.Itoa(attempt)
+	}
+	sum := sha256.Sum256([]byte(input))
+
+	alias := make([]byte, 0, g.length)
+	for i := 0; len(alias) < g.length; i++ {
+		chunk := binary.BigEndian.Uint64(sum[(i*8)%len(sum):])
+		alias = append(alias, encodeBase62(chunk, maxCounterLength)...)
+	}
+	return string(alias[:g.length])
+}
+
+func (g hashGenerator) Length() int {
+	return g.length
+}
+
+func (g hashGenerator) WithLength(length int) (AliasGenerator, error) {
+	return NewAliasGenerator(StrategyHash, length)
+}
+
+// encodeBase62 writes n in base62, left-padded with zeros to length symbols.
+func encodeBase62(n uint64, length int) string {
+	base := uint64(len(random.Base62))
+	buf := make([]byte, length)
+	for i := length - 1; i >= 0; i-- {
+		buf[i] = random.Base62[n%base]
+		n /= base
+	}
+	return string(buf)
+}
@@ -0,0 +1,89 @@
+package service
+
+import (
+	"context"
+	"time"
+
+	"github.com/DeneesK/short-url/internal/app/dto"
+)
+
+const (
+	clickQueueSize     = 4096
+	clickBatchSize     = 500
+	clickFlushInterval = time.Second
+)
+
+// clickRecorder buffers click events and writes them to the repository
+// in batches so that redirects never wait for the storage.
+type clickRecorder struct {
+	rep    Repository
+	log    Logger
+	events chan dto.Click
+	done   chan struct{}
+}
+
+func newClickRecorder(rep Repository, log Logger) *clickRecorder {
+	c := &clickRecorder{
+		rep:    rep,
+		log:    log,
+		events: make(chan dto.Click, clickQueueSize),
+		done:   make(chan struct{}),
+	}
+	go c.run()
+	return c
+}
+
+// record enqueues click and reports false if the queue is full and the
+// event was dropped.
+func (c *clickRecorder) record(click dto.Click) bool {
+	select {
+	case c.events <- click:
+		return true
+	default:
+		return false
+	}
+}
+
+func (c *clickRecorder) close() {
+	close(c.events)
+	<-c.done
+}
+
+func (c *clickRecorder) run() {
+	defer close(c.done)
+
+	ticker := time.NewTicker(clickFlushInterval)
+	defer ticker.Stop()
+
+	pending := make([]dto.Click, 0, clickBatchSize)
+
+	for {
+		select {
+		case click, ok := <-c.events:
+			if !ok {
+				c.flush(pending)
+				return
+			}
+			pending = append(pending, click)
+			if len(pending) >= clickBatchSize {
+				c.flush(pending)
+				pending = make([]dto.Click, 0, clickBatchSize)
+			}
+		case <-ticker.C:
+			if len(pending) == 0 {
+				continue
+			}
+			c.flush(pending)
+			pending = make([]dto.Click, 0, clickBatchSize)
+		}
+	}
+}
+
+func (c *clickRecorder) flush(pending []dto.Click) {
+	if len(pending) == 0 {
+		return
+	}
+	if err := c.rep.StoreClicks(context.Background(), pending); err != nil {
+		c.log.Errorf("failed to store %d clicks: %s", len(pending), err)
+	}
+}
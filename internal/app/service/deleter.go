@@ -0,0 +1,93 @@
+package service
+
+import (
+	"context"
+	"time"
+)
+
+const (
+	deleteQueueSize     = 1024
+	deleteBatchSize     = 100
+	deleteFlushInterval = time.Second
+)
+
+type deleteTask struct {
+	userID  string
+	aliases []string
+}
+
+// deleter accumulates delete requests and flushes them to the repository
+// in batches, one statement per user.
+type deleter struct {
+	rep   Repository
+	log   Logger
+	tasks chan deleteTask
+	done  chan struct{}
+}
+
+func newDeleter(rep Repository, log Logger) *deleter {
+	d := &deleter{
+		rep:   rep,
+		log:   log,
+		tasks: make(chan deleteTask, deleteQueueSize),
+		done:  make(chan struct{}),
+	}
+	go d.run()
+	return d
+}
+
+func (d *deleter) enqueue(ctx context.Context, task deleteTask) error {
+	select {
+	case d.tasks <- task:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (d *deleter) close() {
+	close(d.tasks)
+	<-d.done
+}
+
+func (d *deleter) run() {
+	defer close(d.done)
+
+	ticker := time.NewTicker(deleteFlushInterval)
+	defer ticker.Stop()
+
+	pending := make(map[string][]string)
+	size := 0
+
+	for {
+		select {
+		case task, ok := <-d.tasks:
+			if !ok {
+				d.flush(pending)
+				return
+			}
+			pending[task.userID] = append(pending[task.userID], task.aliases...)
+			size += len(task.aliases)
+			if size >= deleteBatchSize {
+				d.flush(pending)
+				pending = make(map[string][]string)
+				size = 0
+			}
+		case <-ticker.C:
+			if size == 0 {
+				continue
+			}
+			d.flush(pending)
+			pending = make(map[string][]string)
+			size = 0
+		}
+	}
+}
+
+func (d *deleter) flush(pending map[string][]string) {
+	for userID, aliases := range pending {
+		if err := d.rep.DeleteBatch(context.Background(), userID, aliases); err != nil {
+			d.log.Errorf("failed to delete urls of user %s: %s", userID, err)
+		}
+	}
+}
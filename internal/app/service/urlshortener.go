@@ -5,52 +5,132 @@ import (
 	"errors"
 	"fmt"
 	"net/url"
+	"strings"
 	"time"
 
+	"github.com/DeneesK/short-url/internal/app/auth"
 	"github.com/DeneesK/short-url/internal/app/dto"
 	"github.com/DeneesK/short-url/internal/app/storage"
-	"github.com/DeneesK/short-url/pkg/random"
 	"github.com/DeneesK/short-url/pkg/validator"
+	"go.uber.org/zap"
 )
 
 var ErrLongURLAlreadyExists = errors.New("long URL already exists")
+var ErrUnauthorized = errors.New("user is not authorized")
+var ErrURLDeleted = errors.New("url has been deleted")
+var ErrAliasAlreadyTaken = errors.New("alias is already taken")
+var ErrInvalidAlias = errors.New("alias is not valid")
+var ErrAliasNotAllowed = errors.New("only trusted clients may ask for aliases in batches")
+var ErrURLExpired = errors.New("url has expired")
+var ErrInvalidExpiry = errors.New("expiration is not valid")
+var ErrForbidden = errors.New("access denied")
+var ErrNotFound = errors.New("url not found")
+var ErrInvalidRange = errors.New("time range is not valid")
 
 const (
 	maxRetries = 3
 	idLength   = 8
 	sleepTime  = 100
+
+	defaultStatsPeriod = 30 * 24 * time.Hour
+	statsTopSize       = 10
 )
 
+// reservedAliases would shadow service routes if used as custom aliases.
+var reservedAliases = map[string]struct{}{
+	"api":     {},
+	"ping":    {},
+	"user":    {},
+	"admin":   {},
+	"metrics": {},
+	"stats":   {},
+	"health":  {},
+}
+
 type Repository interface {
-	Store(context.Context, string, string) (string, error)
-	StoreBatch(context.Context, []dto.OriginalURL) error
+	Store(ctx context.Context, id, value, userID string, expiresAt *time.Time) (string, error)
+	StoreBatch(ctx context.Context, batch []dto.OriginalURL, userID string, atomic bool) ([]storage.BatchResult, error)
 	Get(context.Context, string) (string, error)
+	GetByUserID(context.Context, string) ([]dto.UserURL, error)
+	DeleteBatch(ctx context.Context, userID string, aliases []string) error
+	StoreClicks(ctx context.Context, clicks []dto.Click) error
+	GetOwner(ctx context.Context, id string) (string, error)
+	ClickStats(ctx context.Context, alias string, from, to time.Time, top int) (dto.LinkStats, error)
+	PoolStats() (dto.PoolStats, bool)
+	MemoryStats() (dto.MemoryStats, bool)
 	PingDB(context.Context) error
 }
 
+// Logger reports failures of work done in the background.
+type Logger interface {
+	Errorf(template string, args ...interface{})
+}
+
 type URLShortener struct {
 	rep      Repository
 	baseAddr string
+	aliases  *aliasPolicy
+	deleter  *deleter
+	clicks   *clickRecorder
+	log      Logger
 }
 
-func NewURLShortener(storage Repository, baseAddr string) *URLShortener {
-	return &URLShortener{
+type Option func(*URLShortener)
+
+func NewURLShortener(storage Repository, baseAddr string, opts ...Option) *URLShortener {
+	s := &URLShortener{
 		rep:      storage,
 		baseAddr: baseAddr,
+		aliases:  newAliasPolicy(randomGenerator{length: idLength}),
+		log:      zap.NewNop().Sugar(),
 	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	s.deleter = newDeleter(storage, s.log)
+	s.clicks = newClickRecorder(storage, s.log)
+	return s
 }
 
-func (s *URLShortener) ShortenURL(ctx context.Context, longURL string) (string, error) {
-	var alias string
-	var err error
+// WithLogger reports failures of deferred deletes and click recording to
+// log instead of dropping them silently.
+func WithLogger(log Logger) Option {
+	return func(s *URLShortener) {
+		s.log = log
+	}
+}
+
+func WithAliasGenerator(generator AliasGenerator) Option {
+	return func(s *URLShortener) {
+		s.aliases = newAliasPolicy(generator)
+	}
+}
+
+// ShortenURL stores longURL under opts.Alias or, if it is empty, under a
+// randomly generated alias.
+func (s *URLShortener) ShortenURL(ctx context.Context, longURL string, opts dto.ShortenOptions) (string, error) {
 	if isValid := validator.IsValidURL(longURL); !isValid {
 		return "", fmt.Errorf("this url: '%s' is not valid url", longURL)
 	}
+	userID, _ := auth.UserIDFromContext(ctx)
+	expiresAt, err := resolveExpiry(opts.ExpiresAt, opts.TTLSeconds)
+	if err != nil {
+		return "", err
+	}
+
+	if opts.Alias != "" {
+		return s.shortenWithAlias(ctx, longURL, opts.Alias, userID, expiresAt)
+	}
 
+	var alias string
 	for i := 0; i < maxRetries; i++ {
-		alias = random.RandomString(idLength)
+		alias = s.aliases.generate(longURL, i)
 
-		alias, err = s.rep.Store(ctx, alias, longURL)
+		alias, err = s.rep.Store(ctx, alias, longURL, userID, expiresAt)
+		// Only the outcomes that tell whether the alias was free count.
+		if err == nil || errors.Is(err, storage.ErrNotUniqueID) {
+			s.aliases.observe(err != nil)
+		}
 		if err != nil {
 			if errors.Is(err, storage.ErrNotUniqueID) {
 				continue
@@ -67,6 +147,9 @@ func (s *URLShortener) ShortenURL(ctx context.Context, longURL string) (string,
 		}
 		break
 	}
+	if errors.Is(err, storage.ErrNotUniqueID) {
+		s.aliases.exhausted()
+	}
 	if err != nil {
 		return "", fmt.Errorf("failed to store shorten URL after %d attempts, reason: %q", maxRetries, err)
 	}
@@ -78,34 +161,314 @@ func (s *URLShortener) ShortenURL(ctx context.Context, longURL string) (string,
 	return shortURL, nil
 }
 
+func (s *URLShortener) shortenWithAlias(ctx context.Context, longURL, alias, userID string, expiresAt *time.Time) (string, error) {
+	if err := validateAlias(alias); err != nil {
+		return "", err
+	}
+
+	stored, err := s.rep.Store(ctx, alias, longURL, userID, expiresAt)
+	if errors.Is(err, storage.ErrNotUniqueID) {
+		return "", fmt.Errorf("%w: %q", ErrAliasAlreadyTaken, alias)
+	} else if errors.Is(err, storage.ErrUniqueViolation) {
+		shortURL, err := url.JoinPath(s.baseAddr, stored)
+		if err != nil {
+			return "", err
+		}
+		return shortURL, ErrLongURLAlreadyExists
+	} else if err != nil {
+		return "", err
+	}
+
+	return url.JoinPath(s.baseAddr, stored)
+}
+
+// validateAlias checks that a client requested alias is well-formed and
+// does not shadow any of the service routes.
+func validateAlias(alias string) error {
+	if !validator.IsValidAlias(alias) {
+		return fmt.Errorf("%w: %q", ErrInvalidAlias, alias)
+	}
+	if _, ok := reservedAliases[strings.ToLower(alias)]; ok {
+		return fmt.Errorf("%w: %q is reserved", ErrInvalidAlias, alias)
+	}
+	return nil
+}
+
 func (s *URLShortener) FindByShortened(ctx context.Context, id string) (string, error) {
 	shortURL, err := s.rep.Get(ctx, id)
-	if err != nil {
-		return "", nil
+	if errors.Is(err, storage.ErrDeleted) {
+		return "", ErrURLDeleted
+	} else if errors.Is(err, storage.ErrExpired) {
+		return "", ErrURLExpired
+	} else if errors.Is(err, storage.ErrNotFound) {
+		return "", ErrNotFound
+	} else if err != nil {
+		return "", err
 	}
 	return shortURL, nil
 }
 
-func (s *URLShortener) StoreBatchURL(ctx context.Context, batch []dto.OriginalURL) ([]dto.ShortedURL, error) {
-	result := make([]dto.ShortedURL, 0, len(batch))
-	for _, origin := range batch {
-		if isValid := validator.IsValidURL(origin.URL); !isValid {
-			return nil, fmt.Errorf("%q is not valid url", origin.URL)
+// StoreBatchURL shortens every item of batch on its own: invalid items are
+// reported with StatusInvalid and the rest are stored under generated
+// aliases, or under the aliases they explicitly request if the client is
+// trusted. With opts.Atomic set any invalid item rejects the whole batch and
+// nothing is stored.
+func (s *URLShortener) StoreBatchURL(ctx context.Context, batch []dto.OriginalURL, opts dto.BatchOptions) ([]dto.ShortedURL, error) {
+	result := make([]dto.ShortedURL, len(batch))
+	valid := make([]dto.OriginalURL, 0, len(batch))
+	positions := make([]int, 0, len(batch))
+	trusted := auth.IsTrustedClient(ctx)
+	for i, origin := range batch {
+		expiresAt, err := validateBatchItem(origin, trusted)
+		if err != nil {
+			if opts.Atomic {
+				return nil, err
+			}
+			result[i] = dto.ShortedURL{ID: origin.ID, Status: dto.StatusInvalid, Error: err.Error()}
+			continue
+		}
+		origin.ExpiresAt = expiresAt
+		valid = append(valid, origin)
+		positions = append(positions, i)
+	}
+	if len(valid) == 0 {
+		return result, nil
+	}
+
+	userID, _ := auth.UserIDFromContext(ctx)
+	stored, err := s.storeBatch(ctx, valid, userID, opts.Atomic)
+	if errors.Is(err, storage.ErrNotUniqueID) {
+		return nil, fmt.Errorf("%w: %w", ErrAliasAlreadyTaken, err)
+	} else if err != nil {
+		return nil, err
+	}
+
+	for j, row := range stored {
+		i := positions[j]
+		if errors.Is(row.Err, storage.ErrNotUniqueID) {
+			result[i] = dto.ShortedURL{ID: row.ID, Status: dto.StatusInvalid, Error: ErrAliasAlreadyTaken.Error()}
+			continue
+		} else if row.Err != nil {
+			result[i] = dto.ShortedURL{ID: row.ID, Status: dto.StatusInvalid, Error: row.Err.Error()}
+			continue
 		}
-		shortURL, err := url.JoinPath(s.baseAddr, origin.ID)
+		shortURL, err := url.JoinPath(s.baseAddr, row.Alias)
 		if err != nil {
 			return nil, err
 		}
-		result = append(result, dto.ShortedURL{ID: origin.ID, URL: shortURL})
+		status := dto.StatusCreated
+		if row.Existing {
+			status = dto.StatusExisting
+		}
+		result[i] = dto.ShortedURL{ID: row.ID, URL: shortURL, Status: status}
+	}
+	return result, nil
+}
+
+// storeBatch stores items under their requested aliases or under generated
+// ones. Generated aliases that collide are regenerated and stored again, up
+// to maxRetries times, the same way ShortenURL does for a single URL. An
+// atomic batch rejected because of a requested alias fails right away. The
+// results are returned in the order of items.
+func (s *URLShortener) storeBatch(ctx context.Context, items []dto.OriginalURL, userID string, atomic bool) ([]storage.BatchResult, error) {
+	generated := make([]bool, len(items))
+	pending := make([]int, 0, len(items))
+	for i := range items {
+		generated[i] = items[i].Alias == ""
+		pending = append(pending, i)
 	}
 
-	err := s.rep.StoreBatch(ctx, batch)
+	results := make([]storage.BatchResult, len(items))
+	var err error
+	for attempt := 0; attempt < maxRetries && len(pending) > 0; attempt++ {
+		batch := make([]dto.OriginalURL, 0, len(pending))
+		hasGenerated := false
+		for _, i := range pending {
+			if generated[i] {
+				items[i].Alias = s.aliases.generate(items[i].URL, attempt)
+				hasGenerated = true
+			}
+			batch = append(batch, items[i])
+		}
+
+		var stored []storage.BatchResult
+		stored, err = s.rep.StoreBatch(ctx, batch, userID, atomic)
+		if errors.Is(err, storage.ErrNotUniqueID) && atomic && hasGenerated && !requested(items, generated, err) {
+			// Nothing has been stored, so the whole batch is tried again.
+			s.aliases.observe(true)
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+
+		retry := make([]int, 0)
+		for j, row := range stored {
+			i := pending[j]
+			collided := errors.Is(row.Err, storage.ErrNotUniqueID)
+			if generated[i] {
+				if collided || row.Err == nil && !row.Existing {
+					s.aliases.observe(collided)
+				}
+				if collided {
+					retry = append(retry, i)
+					continue
+				}
+			}
+			results[i] = row
+		}
+		pending = retry
+	}
+
+	if len(pending) > 0 {
+		s.aliases.exhausted()
+		if err != nil {
+			return nil, err
+		}
+		for _, i := range pending {
+			results[i] = storage.BatchResult{ID: items[i].ID, Err: storage.ErrNotUniqueID}
+		}
+	}
+	return results, nil
+}
+
+// requested reports whether err rejects a batch because of an alias one of
+// items asks for rather than a generated one.
+func requested(items []dto.OriginalURL, generated []bool, err error) bool {
+	var aliasErr *storage.AliasError
+	if !errors.As(err, &aliasErr) {
+		return false
+	}
+	for i := range items {
+		if !generated[i] && items[i].Alias == aliasErr.Alias {
+			return true
+		}
+	}
+	return false
+}
+
+// validateBatchItem checks a single batch item and returns its resolved
+// expiration time. Only trusted clients may ask for an alias.
+func validateBatchItem(origin dto.OriginalURL, trusted bool) (*time.Time, error) {
+	if isValid := validator.IsValidURL(origin.URL); !isValid {
+		return nil, fmt.Errorf("%q is not valid url", origin.URL)
+	}
+	if origin.Alias != "" {
+		if !trusted {
+			return nil, fmt.Errorf("%w: %q", ErrAliasNotAllowed, origin.Alias)
+		}
+		if err := validateAlias(origin.Alias); err != nil {
+			return nil, err
+		}
+	}
+	return resolveExpiry(origin.ExpiresAt, origin.TTLSeconds)
+}
+
+func (s *URLShortener) FindByUser(ctx context.Context) ([]dto.UserURL, error) {
+	userID, ok := auth.UserIDFromContext(ctx)
+	if !ok {
+		return nil, ErrUnauthorized
+	}
+
+	urls, err := s.rep.GetByUserID(ctx, userID)
 	if err != nil {
 		return nil, err
 	}
+	for i := range urls {
+		shortURL, err := url.JoinPath(s.baseAddr, urls[i].ShortURL)
+		if err != nil {
+			return nil, err
+		}
+		urls[i].ShortURL = shortURL
+	}
+	return urls, nil
+}
 
-	return result, nil
+// DeleteUserURLs schedules deletion of the caller's aliases and returns
+// without waiting for the repository.
+func (s *URLShortener) DeleteUserURLs(ctx context.Context, aliases []string) error {
+	userID, ok := auth.UserIDFromContext(ctx)
+	if !ok {
+		return ErrUnauthorized
+	}
+	if len(aliases) == 0 {
+		return nil
+	}
+	return s.deleter.enqueue(ctx, deleteTask{userID: userID, aliases: aliases})
+}
+
+// resolveExpiry turns either an absolute timestamp or a TTL into an
+// expiration time; nil means the link never expires.
+func resolveExpiry(expiresAt *time.Time, ttlSeconds int64) (*time.Time, error) {
+	switch {
+	case expiresAt != nil && ttlSeconds != 0:
+		return nil, fmt.Errorf("%w: expires_at and ttl_seconds are mutually exclusive", ErrInvalidExpiry)
+	case ttlSeconds < 0:
+		return nil, fmt.Errorf("%w: ttl_seconds must be positive", ErrInvalidExpiry)
+	case ttlSeconds > 0:
+		t := time.Now().Add(time.Duration(ttlSeconds) * time.Second)
+		return &t, nil
+	case expiresAt != nil && !expiresAt.After(time.Now()):
+		return nil, fmt.Errorf("%w: expires_at is in the past", ErrInvalidExpiry)
+	}
+	return expiresAt, nil
 }
+
+// RecordClick enqueues click for asynchronous persisting. Events are
+// dropped when the queue is full.
+func (s *URLShortener) RecordClick(click dto.Click) {
+	s.clicks.record(click)
+}
+
+// Stats aggregates clicks of alias within [from, to). Zero bounds default
+// to the last 30 days. Only the owner of alias may read its statistics.
+func (s *URLShortener) Stats(ctx context.Context, alias string, from, to time.Time) (dto.LinkStats, error) {
+	userID, ok := auth.UserIDFromContext(ctx)
+	if !ok {
+		return dto.LinkStats{}, ErrUnauthorized
+	}
+
+	owner, err := s.rep.GetOwner(ctx, alias)
+	if errors.Is(err, storage.ErrNotFound) {
+		return dto.LinkStats{}, ErrNotFound
+	} else if err != nil {
+		return dto.LinkStats{}, err
+	}
+	if owner != userID {
+		return dto.LinkStats{}, ErrForbidden
+	}
+
+	if to.IsZero() {
+		to = time.Now()
+	}
+	if from.IsZero() {
+		from = to.Add(-defaultStatsPeriod)
+	}
+	if !from.Before(to) {
+		return dto.LinkStats{}, ErrInvalidRange
+	}
+
+	return s.rep.ClickStats(ctx, alias, from.UTC(), to.UTC(), statsTopSize)
+}
+
+func (s *URLShortener) Diagnostics(ctx context.Context) dto.Diagnostics {
+	diag := dto.Diagnostics{
+		Aliases: s.aliases.diagnostics(),
+	}
+	if stats, ok := s.rep.PoolStats(); ok {
+		diag.Pool = &stats
+	}
+	if stats, ok := s.rep.MemoryStats(); ok {
+		diag.Memory = &stats
+	}
+	return diag
+}
+
 func (s *URLShortener) PingDB(ctx context.Context) error {
 	return s.rep.PingDB(ctx)
 }
+
+// Close flushes pending deletions and stops background workers.
+func (s *URLShortener) Close() {
+	s.deleter.close()
+	s.clicks.close()
+}
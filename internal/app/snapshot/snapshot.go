@@ -0,0 +1,505 @@
+// Package snapshot implements a compact binary format for snapshots of
+// the stored links.
+//
+// A snapshot starts with a header of fixed size:
+//
+//	magic       8 bytes "SURLSNAP"
+//	version     2 bytes
+//	compression 1 byte
+//	flags       1 byte, reserved in version 1
+//	rows        8 bytes
+//	checksum    4 bytes, CRC-32C of the uncompressed rows
+//
+// followed by the rows, compressed as a whole. Every row is a flags byte,
+// the alias, the long URL and the user ID, each prefixed by its uvarint
+// length, and the expiration time in Unix nanoseconds as a varint if the
+// flags have it. All integers of the header are big-endian.
+//
+// If the header flags it, the compressed rows are encrypted in chunks of up
+// to 64 KiB. Every chunk is prefixed by the 4 byte length of its sealed
+// form, whose top bit marks the last chunk. The chunk number and that bit
+// are authenticated with the chunk, so chunks cannot be reordered or cut
+// off.
+package snapshot
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Version is the version of the format written by Writer.
+const Version = 2
+
+const (
+	filePerm   = 0600
+	magic      = "SURLSNAP"
+	headerSize = 24
+	// maxFieldSize bounds a field, so a corrupt length is not mistaken for
+	// a huge field.
+	maxFieldSize = 16 << 20
+	chunkSize    = 64 << 10
+	// maxSealedChunkSize leaves room for the overhead of sealing a chunk.
+	maxSealedChunkSize = chunkSize + 1<<10
+	lastChunk          = 1 << 31
+)
+
+const headerEncrypted = 1
+
+const (
+	flagDeleted = 1 << iota
+	flagEvicted
+	flagExpires
+)
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+var (
+	ErrNotSnapshot        = errors.New("not a snapshot")
+	ErrUnsupportedVersion = errors.New("unsupported snapshot version")
+	ErrCorrupt            = errors.New("snapshot is corrupt")
+	ErrEncrypted          = errors.New("snapshot is encrypted and no cipher is given")
+)
+
+// Cipher seals the chunks of an encrypted snapshot.
+type Cipher interface {
+	Seal(plaintext, additionalData []byte) []byte
+	Open(sealed, additionalData []byte) ([]byte, error)
+}
+
+// Compression of the rows of a snapshot.
+type Compression uint8
+
+const (
+	CompressionNone Compression = iota
+	CompressionGzip
+	CompressionZstd
+)
+
+var compressionNames = map[Compression]string{
+	CompressionNone: "none",
+	CompressionGzip: "gzip",
+	CompressionZstd: "zstd",
+}
+
+func (c Compression) String() string {
+	if name, ok := compressionNames[c]; ok {
+		return name
+	}
+	return fmt.Sprintf("compression(%d)", uint8(c))
+}
+
+// ParseCompression accepts "none", "gzip" or "zstd".
+func ParseCompression(compression string) (Compression, error) {
+	for c, name := range compressionNames {
+		if strings.EqualFold(compression, name) {
+			return c, nil
+		}
+	}
+	if compression == "" {
+		return CompressionNone, nil
+	}
+	return 0, fmt.Errorf("unknown snapshot compression %q", compression)
+}
+
+// Row is a link kept in a snapshot.
+type Row struct {
+	ShortURL  string
+	LongURL   string
+	UserID    string
+	Deleted   bool
+	ExpiresAt *time.Time
+	Evicted   bool
+}
+
+// Writer writes a snapshot to a file.
+type Writer struct {
+	file     *os.File
+	out      io.WriteCloser
+	body     io.WriteCloser
+	buf      *bufio.Writer
+	checksum hash.Hash32
+	rows     uint64
+	row      []byte
+	compress Compression
+	flags    byte
+}
+
+// Create creates a snapshot at path, truncating the file if it exists. The
+// rows are encrypted with c unless it is nil.
+func Create(path string, compression Compression, c Cipher) (*Writer, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, filePerm)
+	if err != nil {
+		return nil, err
+	}
+	// A file left over by an earlier attempt keeps its permissions.
+	if err := file.Chmod(filePerm); err != nil {
+		file.Close()
+		return nil, err
+	}
+	// The header is written once the rows are counted.
+	if _, err := file.Write(make([]byte, headerSize)); err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	var out io.WriteCloser = nopCloser{file}
+	var flags byte
+	if c != nil {
+		out = &sealWriter{w: file, cipher: c}
+		flags |= headerEncrypted
+	}
+
+	var body io.WriteCloser
+	switch compression {
+	case CompressionNone:
+		body = nopCloser{out}
+	case CompressionGzip:
+		body = gzip.NewWriter(out)
+	case CompressionZstd:
+		body, err = zstd.NewWriter(out, zstd.WithEncoderConcurrency(1))
+	default:
+		err = fmt.Errorf("unknown snapshot compression %d", compression)
+	}
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	return &Writer{
+		file:     file,
+		out:      out,
+		body:     body,
+		buf:      bufio.NewWriter(body),
+		checksum: crc32.New(crcTable),
+		compress: compression,
+		flags:    flags,
+	}, nil
+}
+
+// Write appends a row to the snapshot.
+func (w *Writer) Write(r Row) error {
+	var flags byte
+	if r.Deleted {
+		flags |= flagDeleted
+	}
+	if r.Evicted {
+		flags |= flagEvicted
+	}
+	if r.ExpiresAt != nil {
+		flags |= flagExpires
+	}
+
+	w.row = append(w.row[:0], flags)
+	for _, field := range []string{r.ShortURL, r.LongURL, r.UserID} {
+		w.row = binary.AppendUvarint(w.row, uint64(len(field)))
+		w.row = append(w.row, field...)
+	}
+	if r.ExpiresAt != nil {
+		w.row = binary.AppendVarint(w.row, r.ExpiresAt.UnixNano())
+	}
+
+	w.checksum.Write(w.row)
+	if _, err := w.buf.Write(w.row); err != nil {
+		return err
+	}
+	w.rows++
+	return nil
+}
+
+// Close completes the snapshot, syncs and closes its file.
+func (w *Writer) Close() error {
+	err := w.finish()
+	if closeErr := w.file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+func (w *Writer) finish() error {
+	if err := w.buf.Flush(); err != nil {
+		return err
+	}
+	if err := w.body.Close(); err != nil {
+		return err
+	}
+	if err := w.out.Close(); err != nil {
+		return err
+	}
+
+	header := make([]byte, 0, headerSize)
+	header = append(header, magic...)
+	header = binary.BigEndian.AppendUint16(header, Version)
+	header = append(header, byte(w.compress), w.flags)
+	header = binary.BigEndian.AppendUint64(header, w.rows)
+	header = binary.BigEndian.AppendUint32(header, w.checksum.Sum32())
+	if _, err := w.file.WriteAt(header, 0); err != nil {
+		return err
+	}
+	return w.file.Sync()
+}
+
+// Read calls fn with every row of the snapshot read from r. The snapshot is
+// read twice: first to check it against the header, then to call fn, so fn
+// is never called for rows of a snapshot found corrupt and no more than a
+// row is held in memory at a time. It returns ErrNotSnapshot if r does not
+// start with a snapshot header. An encrypted snapshot is decrypted with c.
+func Read(r io.ReadSeeker, c Cipher, fn func(Row) error) error {
+	start, err := r.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	if err := read(r, c, nil); err != nil {
+		return err
+	}
+	if _, err := r.Seek(start, io.SeekStart); err != nil {
+		return err
+	}
+	return read(r, c, fn)
+}
+
+// read decodes the snapshot read from r, calling fn with every row unless
+// it is nil.
+func read(r io.Reader, c Cipher, fn func(Row) error) error {
+	br := bufio.NewReader(r)
+	header := make([]byte, headerSize)
+	if n, err := io.ReadFull(br, header); err != nil {
+		// A header cut short is corruption, anything else is not ours.
+		if n > 0 && bytes.HasPrefix([]byte(magic), header[:n]) {
+			return ErrCorrupt
+		}
+		return ErrNotSnapshot
+	}
+	if string(header[:len(magic)]) != magic {
+		return ErrNotSnapshot
+	}
+	version := binary.BigEndian.Uint16(header[8:])
+	if version == 0 || version > Version {
+		return fmt.Errorf("%w: %d", ErrUnsupportedVersion, version)
+	}
+	rows := binary.BigEndian.Uint64(header[12:])
+	checksum := binary.BigEndian.Uint32(header[20:])
+
+	var in io.Reader = br
+	if version > 1 && header[11]&headerEncrypted != 0 {
+		if c == nil {
+			return ErrEncrypted
+		}
+		in = &openReader{r: br, cipher: c}
+	}
+
+	var body io.Reader
+	switch Compression(header[10]) {
+	case CompressionNone:
+		body = in
+	case CompressionGzip:
+		gz, err := gzip.NewReader(in)
+		if err != nil {
+			return fmt.Errorf("%w: %v", ErrCorrupt, err)
+		}
+		defer gz.Close()
+		body = gz
+	case CompressionZstd:
+		zr, err := zstd.NewReader(in, zstd.WithDecoderConcurrency(1), zstd.WithDecoderLowmem(true))
+		if err != nil {
+			return err
+		}
+		defer zr.Close()
+		body = zr
+	default:
+		return fmt.Errorf("%w: unknown compression %d", ErrCorrupt, header[10])
+	}
+
+	crc := crc32.New(crcTable)
+	rr := bufio.NewReader(io.TeeReader(body, crc))
+	for i := uint64(0); i < rows; i++ {
+		row, err := readRow(rr)
+		if err != nil {
+			return fmt.Errorf("%w: row %d: %v", ErrCorrupt, i, err)
+		}
+		if fn == nil {
+			continue
+		}
+		if err := fn(row); err != nil {
+			return err
+		}
+	}
+	// Anything past the counted rows is corruption as well.
+	if n, err := io.Copy(io.Discard, rr); err != nil {
+		return fmt.Errorf("%w: %v", ErrCorrupt, err)
+	} else if n > 0 {
+		return fmt.Errorf("%w: %d bytes past the last row", ErrCorrupt, n)
+	}
+	if crc.Sum32() != checksum {
+		return fmt.Errorf("%w: checksum mismatch", ErrCorrupt)
+	}
+	return nil
+}
+
+func readRow(r *bufio.Reader) (Row, error) {
+	flags, err := r.ReadByte()
+	if err != nil {
+		return Row{}, unexpected(err)
+	}
+	var fields [3]string
+	for i := range fields {
+		length, err := binary.ReadUvarint(r)
+		if err != nil {
+			return Row{}, unexpected(err)
+		}
+		if length > maxFieldSize {
+			return Row{}, fmt.Errorf("field of %d bytes", length)
+		}
+		field := make([]byte, length)
+		if _, err := io.ReadFull(r, field); err != nil {
+			return Row{}, unexpected(err)
+		}
+		fields[i] = string(field)
+	}
+
+	row := Row{
+		ShortURL: fields[0],
+		LongURL:  fields[1],
+		UserID:   fields[2],
+		Deleted:  flags&flagDeleted != 0,
+		Evicted:  flags&flagEvicted != 0,
+	}
+	if flags&flagExpires != 0 {
+		nanos, err := binary.ReadVarint(r)
+		if err != nil {
+			return Row{}, unexpected(err)
+		}
+		expiresAt := time.Unix(0, nanos).UTC()
+		row.ExpiresAt = &expiresAt
+	}
+	return row, nil
+}
+
+func unexpected(err error) error {
+	if errors.Is(err, io.EOF) {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// sealWriter seals what is written to it in chunks.
+type sealWriter struct {
+	w      io.Writer
+	cipher Cipher
+	buf    []byte
+	chunk  uint64
+}
+
+func (s *sealWriter) Write(p []byte) (int, error) {
+	n := len(p)
+	for len(p) > 0 {
+		take := min(chunkSize-len(s.buf), len(p))
+		s.buf = append(s.buf, p[:take]...)
+		p = p[take:]
+		if len(s.buf) == chunkSize {
+			if err := s.flush(false); err != nil {
+				return 0, err
+			}
+		}
+	}
+	return n, nil
+}
+
+// Close writes the last chunk, which may be empty.
+func (s *sealWriter) Close() error {
+	return s.flush(true)
+}
+
+func (s *sealWriter) flush(last bool) error {
+	length := uint32(0)
+	if last {
+		length = lastChunk
+	}
+	sealed := s.cipher.Seal(s.buf, chunkAD(s.chunk, last))
+	length |= uint32(len(sealed))
+
+	var prefix [4]byte
+	binary.BigEndian.PutUint32(prefix[:], length)
+	if _, err := s.w.Write(prefix[:]); err != nil {
+		return err
+	}
+	if _, err := s.w.Write(sealed); err != nil {
+		return err
+	}
+	s.chunk++
+	s.buf = s.buf[:0]
+	return nil
+}
+
+// openReader opens chunks sealed by sealWriter.
+type openReader struct {
+	r      io.Reader
+	cipher Cipher
+	buf    []byte
+	chunk  uint64
+	last   bool
+}
+
+func (o *openReader) Read(p []byte) (int, error) {
+	for len(o.buf) == 0 {
+		if o.last {
+			return 0, io.EOF
+		}
+		if err := o.next(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, o.buf)
+	o.buf = o.buf[n:]
+	return n, nil
+}
+
+func (o *openReader) next() error {
+	var prefix [4]byte
+	if _, err := io.ReadFull(o.r, prefix[:]); err != nil {
+		return fmt.Errorf("%w: chunk %d: %v", ErrCorrupt, o.chunk, unexpected(err))
+	}
+	length := binary.BigEndian.Uint32(prefix[:])
+	last := length&lastChunk != 0
+	length &^= lastChunk
+	if length > maxSealedChunkSize {
+		return fmt.Errorf("%w: chunk %d of %d bytes", ErrCorrupt, o.chunk, length)
+	}
+	sealed := make([]byte, length)
+	if _, err := io.ReadFull(o.r, sealed); err != nil {
+		return fmt.Errorf("%w: chunk %d: %v", ErrCorrupt, o.chunk, unexpected(err))
+	}
+	plain, err := o.cipher.Open(sealed, chunkAD(o.chunk, last))
+	if err != nil {
+		return fmt.Errorf("%w: chunk %d: %v", ErrCorrupt, o.chunk, err)
+	}
+	o.buf = plain
+	o.chunk++
+	o.last = last
+	return nil
+}
+
+func chunkAD(chunk uint64, last bool) []byte {
+	ad := binary.BigEndian.AppendUint64(make([]byte, 0, 9), chunk)
+	if last {
+		return append(ad, 1)
+	}
+	return append(ad, 0)
+}
+
+type nopCloser struct {
+	io.Writer
+}
+
+func (nopCloser) Close() error { return nil }
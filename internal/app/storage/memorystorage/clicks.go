@@ -0,0 +1,104 @@
+package memorystorage
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/DeneesK/short-url/internal/app/dto"
+)
+
+const defaultClickBufferSize = 100_000
+
+// clickRing keeps the most recent click events, overwriting the oldest
+// ones once it is full.
+type clickRing struct {
+	m      sync.RWMutex
+	events []dto.Click
+	next   int
+	full   bool
+}
+
+func newClickRing(size int) *clickRing {
+	return &clickRing{events: make([]dto.Click, size)}
+}
+
+func (r *clickRing) add(clicks ...dto.Click) {
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	for _, click := range clicks {
+		r.events[r.next] = click
+		r.next = (r.next + 1) % len(r.events)
+		if r.next == 0 {
+			r.full = true
+		}
+	}
+}
+
+// each calls fn for every stored event from the oldest to the newest.
+func (r *clickRing) each(fn func(dto.Click)) {
+	r.m.RLock()
+	defer r.m.RUnlock()
+
+	if r.full {
+		for _, click := range r.events[r.next:] {
+			fn(click)
+		}
+	}
+	for _, click := range r.events[:r.next] {
+		fn(click)
+	}
+}
+
+func (r *clickRing) stats(alias string, from, to time.Time, top int) dto.LinkStats {
+	result := dto.LinkStats{Alias: alias, From: from, To: to}
+	visitors := make(map[string]struct{})
+	days := make(map[string]int64)
+	referrers := make(map[string]int64)
+	userAgents := make(map[string]int64)
+
+	r.each(func(click dto.Click) {
+		if click.Alias != alias || click.ClickedAt.Before(from) || !click.ClickedAt.Before(to) {
+			return
+		}
+		result.TotalClicks++
+		visitors[click.IP] = struct{}{}
+		days[click.ClickedAt.UTC().Format(time.DateOnly)]++
+		if click.Referrer != "" {
+			referrers[click.Referrer]++
+		}
+		if click.UserAgent != "" {
+			userAgents[click.UserAgent]++
+		}
+	})
+
+	result.UniqueVisitors = int64(len(visitors))
+	result.ClicksPerDay = make([]dto.DailyClicks, 0, len(days))
+	for day, clicks := range days {
+		result.ClicksPerDay = append(result.ClicksPerDay, dto.DailyClicks{Date: day, Clicks: clicks})
+	}
+	sort.Slice(result.ClicksPerDay, func(i, j int) bool {
+		return result.ClicksPerDay[i].Date < result.ClicksPerDay[j].Date
+	})
+	result.TopReferrers = topValues(referrers, top)
+	result.TopUserAgents = topValues(userAgents, top)
+	return result
+}
+
+func topValues(counts map[string]int64, top int) []dto.CountedValue {
+	values := make([]dto.CountedValue, 0, len(counts))
+	for value, count := range counts {
+		values = append(values, dto.CountedValue{Value: value, Count: count})
+	}
+	sort.Slice(values, func(i, j int) bool {
+		if values[i].Count != values[j].Count {
+			return values[i].Count > values[j].Count
+		}
+		return values[i].Value < values[j].Value
+	})
+	if len(values) > top {
+		values = values[:top]
+	}
+	return values
+}
@@ -0,0 +1,188 @@
+package memorystorage
+
+import (
+	"container/list"
+	"fmt"
+	"sync"
+)
+
+// EvictionPolicy decides what happens when the storage is full.
+type EvictionPolicy string
+
+const (
+	// EvictReject rejects new links with ErrStorageLimitExceeded.
+	EvictReject EvictionPolicy = "reject"
+	// EvictLRU evicts the least recently used links.
+	EvictLRU EvictionPolicy = "lru"
+	// EvictLFU evicts the least frequently used links.
+	EvictLFU EvictionPolicy = "lfu"
+)
+
+func ParseEvictionPolicy(policy string) (EvictionPolicy, error) {
+	switch p := EvictionPolicy(policy); p {
+	case EvictReject, EvictLRU, EvictLFU:
+		return p, nil
+	case "":
+		return EvictReject, nil
+	default:
+		return "", fmt.Errorf("unknown eviction policy %q", policy)
+	}
+}
+
+// evictor ranks stored links by their value. It is safe for concurrent use,
+// so that lookups holding only a read lock of the storage can touch links.
+type evictor interface {
+	add(id string)
+	touch(id string)
+	remove(id string)
+	// victim returns the least valuable link without removing it.
+	victim() (string, bool)
+}
+
+func newEvictor(policy EvictionPolicy) evictor {
+	switch policy {
+	case EvictLRU:
+		return newLRUEvictor()
+	case EvictLFU:
+		return newLFUEvictor()
+	default:
+		return nil
+	}
+}
+
+type lruEvictor struct {
+	m     sync.Mutex
+	order *list.List
+	nodes map[string]*list.Element
+}
+
+func newLRUEvictor() *lruEvictor {
+	return &lruEvictor{order: list.New(), nodes: make(map[string]*list.Element)}
+}
+
+func (e *lruEvictor) add(id string) {
+	e.m.Lock()
+	defer e.m.Unlock()
+	if el, ok := e.nodes[id]; ok {
+		e.order.MoveToFront(el)
+		return
+	}
+	e.nodes[id] = e.order.PushFront(id)
+}
+
+func (e *lruEvictor) touch(id string) {
+	e.m.Lock()
+	defer e.m.Unlock()
+	if el, ok := e.nodes[id]; ok {
+		e.order.MoveToFront(el)
+	}
+}
+
+func (e *lruEvictor) remove(id string) {
+	e.m.Lock()
+	defer e.m.Unlock()
+	if el, ok := e.nodes[id]; ok {
+		e.order.Remove(el)
+		delete(e.nodes, id)
+	}
+}
+
+func (e *lruEvictor) victim() (string, bool) {
+	e.m.Lock()
+	defer e.m.Unlock()
+	el := e.order.Back()
+	if el == nil {
+		return "", false
+	}
+	return el.Value.(string), true
+}
+
+// lfuEvictor keeps links in buckets of equal use counts, so every operation
+// takes constant time. Within a bucket the least recently used link goes
+// first.
+type lfuEvictor struct {
+	m       sync.Mutex
+	nodes   map[string]*list.Element
+	buckets map[int]*list.List
+	minFreq int
+}
+
+type lfuEntry struct {
+	id   string
+	freq int
+}
+
+func newLFUEvictor() *lfuEvictor {
+	return &lfuEvictor{nodes: make(map[string]*list.Element), buckets: make(map[int]*list.List)}
+}
+
+func (e *lfuEvictor) add(id string) {
+	e.m.Lock()
+	defer e.m.Unlock()
+	if _, ok := e.nodes[id]; ok {
+		return
+	}
+	e.nodes[id] = e.bucket(1).PushFront(&lfuEntry{id: id, freq: 1})
+	e.minFreq = 1
+}
+
+func (e *lfuEvictor) touch(id string) {
+	e.m.Lock()
+	defer e.m.Unlock()
+	el, ok := e.nodes[id]
+	if !ok {
+		return
+	}
+	entry := el.Value.(*lfuEntry)
+	e.unlink(el)
+	if e.minFreq == entry.freq && e.buckets[entry.freq] == nil {
+		e.minFreq++
+	}
+	entry.freq++
+	e.nodes[id] = e.bucket(entry.freq).PushFront(entry)
+}
+
+func (e *lfuEvictor) remove(id string) {
+	e.m.Lock()
+	defer e.m.Unlock()
+	if el, ok := e.nodes[id]; ok {
+		e.unlink(el)
+		delete(e.nodes, id)
+	}
+}
+
+func (e *lfuEvictor) victim() (string, bool) {
+	e.m.Lock()
+	defer e.m.Unlock()
+	if len(e.nodes) == 0 {
+		return "", false
+	}
+	// minFreq is stale after the last link of its bucket has been removed.
+	if e.buckets[e.minFreq] == nil {
+		e.minFreq = 0
+		for freq := range e.buckets {
+			if e.minFreq == 0 || freq < e.minFreq {
+				e.minFreq = freq
+			}
+		}
+	}
+	return e.buckets[e.minFreq].Back().Value.(*lfuEntry).id, true
+}
+
+func (e *lfuEvictor) bucket(freq int) *list.List {
+	b, ok := e.buckets[freq]
+	if !ok {
+		b = list.New()
+		e.buckets[freq] = b
+	}
+	return b
+}
+
+func (e *lfuEvictor) unlink(el *list.Element) {
+	freq := el.Value.(*lfuEntry).freq
+	b := e.buckets[freq]
+	b.Remove(el)
+	if b.Len() == 0 {
+		delete(e.buckets, freq)
+	}
+}
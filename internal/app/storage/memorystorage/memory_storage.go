@@ -2,66 +2,477 @@ package memorystorage
 
 import (
 	"context"
+	"errors"
+	"sort"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/DeneesK/short-url/internal/app/dto"
 	"github.com/DeneesK/short-url/internal/app/storage"
 )
 
-const stringOverhead = 16
+const defaultShards = 32
 
-type MemoryStorage struct {
+// record is a stored link. A deleted record is a tombstone: it keeps the
+// alias and its owner, so that the alias goes on answering as gone, but
+// not the value.
+type record struct {
+	value     string
+	userID    string
+	deleted   bool
+	expiresAt time.Time
+}
+
+type idempotentRecord struct {
+	resp      dto.IdempotentResponse
+	expiresAt time.Time
+}
+
+func (r record) isExpired(now time.Time) bool {
+	return !r.expiresAt.IsZero() && !r.expiresAt.After(now)
+}
+
+func (r record) link() Link {
+	link := Link{Value: r.value, UserID: r.userID, Deleted: r.deleted}
+	if !r.expiresAt.IsZero() {
+		expiresAt := r.expiresAt
+		link.ExpiresAt = &expiresAt
+	}
+	return link
+}
+
+// shard holds the part of every index whose keys hash to it: links by
+// alias, aliases by long URL and aliases by user.
+type shard struct {
 	m                     sync.RWMutex
-	storage               map[string]string
+	storage               map[string]record
 	uniqueValueConstraint map[string]string
-	currentBytesSize      uint64
-	maxStorageSize        uint64
+	userIndex             map[string][]string
 }
 
-func NewMemoryStorage(maxStorageSize uint64) *MemoryStorage {
-	return &MemoryStorage{
-		storage:               make(map[string]string),
-		uniqueValueConstraint: make(map[string]string),
-		maxStorageSize:        maxStorageSize,
+func newShards(n int) []*shard {
+	shards := make([]*shard, n)
+	for i := range shards {
+		shards[i] = &shard{
+			storage:               make(map[string]record),
+			uniqueValueConstraint: make(map[string]string),
+			userIndex:             make(map[string][]string),
+		}
 	}
+	return shards
 }
 
-func (s *MemoryStorage) Store(ctx context.Context, id, value string) (string, error) {
-	s.m.Lock()
-	defer s.m.Unlock()
+type MemoryStorage struct {
+	shards         []*shard
+	clicks         *clickRing
+	responsesM     sync.RWMutex
+	responses      map[string]idempotentRecord
+	usedBytes      atomic.Uint64
+	peakBytes      atomic.Uint64
+	maxStorageSize uint64
+	evictor        evictor
+	onEvict        func(id string, link Evicted)
+}
 
-	if s.isIDExists(id) {
-		return "", storage.ErrNotUniqueID
+// Link describes a link kept by the storage, deleted or not.
+type Link struct {
+	Value     string
+	UserID    string
+	Deleted   bool
+	ExpiresAt *time.Time
+}
+
+// Evicted describes a link evicted from a full storage.
+type Evicted = Link
+
+type Option func(*MemoryStorage)
+
+// NewMemoryStorage keeps links taking up to maxStorageSize bytes, zero
+// meaning no limit.
+func NewMemoryStorage(maxStorageSize uint64, opts ...Option) *MemoryStorage {
+	s := &MemoryStorage{
+		shards:         newShards(defaultShards),
+		clicks:         newClickRing(defaultClickBufferSize),
+		responses:      make(map[string]idempotentRecord),
+		maxStorageSize: maxStorageSize,
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s
+}
+
+// WithShards spreads the links across n independently locked shards.
+func WithShards(n int) Option {
+	return func(s *MemoryStorage) {
+		if n > 0 {
+			s.shards = newShards(n)
+		}
+	}
+}
+
+// WithEvictionPolicy makes a full storage evict links according to policy
+// instead of rejecting new ones.
+func WithEvictionPolicy(policy EvictionPolicy) Option {
+	return func(s *MemoryStorage) {
+		s.evictor = newEvictor(policy)
+	}
+}
+
+// WithEvictionHandler calls onEvict for every evicted link. It may be
+// called concurrently.
+func WithEvictionHandler(onEvict func(id string, link Evicted)) Option {
+	return func(s *MemoryStorage) {
+		s.onEvict = onEvict
+	}
+}
+
+func (s *MemoryStorage) Store(ctx context.Context, id, value, userID string, expiresAt *time.Time) (string, error) {
+	return s.store(id, value, userID, expiresAt)
+}
+
+// StoreBatch stores every row of batch. Rows that fail are reported with
+// their error, unless atomic is set, in which case the first failure undoes
+// the rows already stored and is returned. Rows are not isolated, so
+// concurrent lookups may see a batch that is rolled back afterwards.
+func (s *MemoryStorage) StoreBatch(ctx context.Context, batch []dto.OriginalURL, userID string, atomic bool) ([]storage.BatchResult, error) {
+	result := make([]storage.BatchResult, 0, len(batch))
+	for _, entity := range batch {
+		alias, err := s.store(entity.Alias, entity.URL, userID, entity.ExpiresAt)
+		if err != nil && !errors.Is(err, storage.ErrUniqueViolation) {
+			if atomic {
+				s.rollback(result)
+				return nil, &storage.AliasError{Alias: entity.Alias, Err: err}
+			}
+			result = append(result, storage.BatchResult{ID: entity.ID, Err: err})
+			continue
+		}
+		result = append(result, storage.BatchResult{
+			ID:       entity.ID,
+			Alias:    alias,
+			Existing: err != nil,
+		})
+	}
+	return result, nil
+}
+
+func (s *MemoryStorage) store(id, value, userID string, expiresAt *time.Time) (string, error) {
+	// Expired links give up their alias, and dead links their value. They
+	// may live in shards other than the ones locked below, so this is done
+	// beforehand.
+	s.removeIfExpired(id)
+	if alias, ok := s.aliasOf(value); ok {
+		s.retire(alias)
 	}
 
-	if s.isValueExists(value) {
-		return s.uniqueValueConstraint[value], storage.ErrUniqueViolation
+	size := s.linkSize(id, value, userID)
+	// Eviction takes shard locks of its own, so with an eviction policy the
+	// room is reserved before the locks below are taken and the part that
+	// turns out not to be needed is given back under them. Otherwise a
+	// concurrent writer could take the room freed for this link.
+	var reserved uint64
+	if s.evictor != nil {
+		reserved = size
+		if userID != "" {
+			reserved += userSize()
+		}
+		if !s.evictAndReserve(reserved) {
+			return "", storage.ErrStorageLimitExceeded
+		}
+	}
+
+	unlock := s.lock(id, value, userID)
+	defer unlock()
+	links := s.shard(id).storage
+	values := s.shard(value).uniqueValueConstraint
+	users := s.shard(userID).userIndex
+
+	// A stored value wins over a taken alias, the way it does in Postgres,
+	// so that storing a value again under the same alias is not mistaken
+	// for an alias collision.
+	if alias, ok := values[value]; ok {
+		s.release(reserved)
+		return alias, storage.ErrUniqueViolation
+	}
+	if _, ok := links[id]; ok {
+		s.release(reserved)
+		return "", storage.ErrNotUniqueID
 	}
 
-	if s.currentBytesSize > s.maxStorageSize {
+	if _, ok := users[userID]; userID != "" && !ok {
+		size += userSize()
+	}
+	if s.evictor != nil {
+		s.release(reserved - size)
+	} else if !s.reserve(size) {
 		return "", storage.ErrStorageLimitExceeded
 	}
 
-	s.storage[id] = value
-	s.uniqueValueConstraint[value] = id
-	s.updateSize(id, value)
+	r := record{value: value, userID: userID}
+	if expiresAt != nil {
+		r.expiresAt = *expiresAt
+	}
+	links[id] = r
+	values[value] = id
+	if userID != "" {
+		users[userID] = append(users[userID], id)
+	}
+	if s.evictor != nil {
+		s.evictor.add(id)
+	}
 	return id, nil
 }
 
-func (s *MemoryStorage) StoreBatch(ctx context.Context, batch []dto.OriginalURL) error {
-	for _, entity := range batch {
-		_, err := s.Store(ctx, entity.ID, entity.URL)
-		if err != nil {
-			return err
+// evictAndReserve removes the least valuable links until size bytes can be
+// reserved. It reports false, evicting nothing, if size exceeds the limit,
+// and false if nothing is left to evict first.
+func (s *MemoryStorage) evictAndReserve(size uint64) bool {
+	if s.maxStorageSize != 0 && size > s.maxStorageSize {
+		return false
+	}
+	for !s.reserve(size) {
+		if !s.evictOne() {
+			return false
+		}
+	}
+	return true
+}
+
+// evictOne removes the least valuable link. It reports false if there is
+// none.
+func (s *MemoryStorage) evictOne() bool {
+	for {
+		id, ok := s.evictor.victim()
+		if !ok {
+			return false
+		}
+		r, ok := s.removeLink(id, nil)
+		if !ok {
+			s.evictor.remove(id)
+			continue
+		}
+		if s.onEvict != nil {
+			s.onEvict(id, r.link())
+		}
+		return true
+	}
+}
+
+func (s *MemoryStorage) Get(ctx context.Context, id string) (storage.Link, error) {
+	sh := s.shard(id)
+	sh.m.RLock()
+	defer sh.m.RUnlock()
+	r, ok := sh.storage[id]
+	if !ok {
+		return storage.Link{}, storage.ErrNotFound
+	}
+	if r.deleted {
+		return storage.Link{}, storage.ErrDeleted
+	}
+	if r.isExpired(time.Now()) {
+		return storage.Link{}, storage.ErrExpired
+	}
+	if s.evictor != nil {
+		s.evictor.touch(id)
+	}
+	link := storage.Link{Value: r.value}
+	if !r.expiresAt.IsZero() {
+		expiresAt := r.expiresAt
+		link.ExpiresAt = &expiresAt
+	}
+	return link, nil
+}
+
+// Snapshot returns a copy of every link by alias. Shards are copied one at
+// a time, so the copy is consistent only if nothing is stored meanwhile.
+func (s *MemoryStorage) Snapshot() map[string]Link {
+	links := make(map[string]Link)
+	for _, sh := range s.shards {
+		sh.m.RLock()
+		for id, r := range sh.storage {
+			links[id] = r.link()
+		}
+		sh.m.RUnlock()
+	}
+	return links
+}
+
+func (s *MemoryStorage) GetByUserID(ctx context.Context, userID string) ([]dto.UserURL, error) {
+	sh := s.shard(userID)
+	sh.m.RLock()
+	aliases := append([]string(nil), sh.userIndex[userID]...)
+	sh.m.RUnlock()
+
+	now := time.Now()
+	result := make([]dto.UserURL, 0, len(aliases))
+	for _, alias := range aliases {
+		sh := s.shard(alias)
+		sh.m.RLock()
+		r, ok := sh.storage[alias]
+		sh.m.RUnlock()
+		if !ok || r.deleted || r.isExpired(now) {
+			continue
+		}
+		result = append(result, dto.UserURL{ShortURL: alias, OriginalURL: r.value})
+	}
+	return result, nil
+}
+
+// DeleteBatch turns the links of aliases owned by userID into tombstones,
+// releasing the bytes their values took.
+func (s *MemoryStorage) DeleteBatch(ctx context.Context, userID string, aliases []string) error {
+	for _, alias := range aliases {
+		s.bury(alias, func(r record) bool { return r.userID == userID })
+	}
+	return nil
+}
+
+// StoreDeleted stores a tombstone of the alias id owned by userID, unless
+// the alias is taken. It restores tombstones kept in snapshots.
+func (s *MemoryStorage) StoreDeleted(id, userID string, expiresAt *time.Time) error {
+	size := s.tombstoneSize(id, userID)
+	var reserved uint64
+	if s.evictor != nil {
+		reserved = size
+		if userID != "" {
+			reserved += userSize()
+		}
+		if !s.evictAndReserve(reserved) {
+			return storage.ErrStorageLimitExceeded
+		}
+	}
+
+	unlock := s.lock(id, userID)
+	defer unlock()
+	links := s.shard(id).storage
+	users := s.shard(userID).userIndex
+	if _, ok := links[id]; ok {
+		s.release(reserved)
+		return nil
+	}
+
+	if _, ok := users[userID]; userID != "" && !ok {
+		size += userSize()
+	}
+	if s.evictor != nil {
+		s.release(reserved - size)
+	} else if !s.reserve(size) {
+		return storage.ErrStorageLimitExceeded
+	}
+
+	r := record{userID: userID, deleted: true}
+	if expiresAt != nil {
+		r.expiresAt = *expiresAt
+	}
+	links[id] = r
+	if userID != "" {
+		users[userID] = append(users[userID], id)
+	}
+	if s.evictor != nil {
+		s.evictor.add(id)
+	}
+	return nil
+}
+
+// PurgeExpired removes expired rows and releases the bytes they occupied.
+func (s *MemoryStorage) PurgeExpired(ctx context.Context) (int, error) {
+	now := time.Now()
+	purged := 0
+	for _, sh := range s.shards {
+		sh.m.RLock()
+		expired := make([]string, 0)
+		for id, r := range sh.storage {
+			if r.isExpired(now) {
+				expired = append(expired, id)
+			}
+		}
+		sh.m.RUnlock()
+
+		for _, id := range expired {
+			if s.removeIfExpired(id) {
+				purged++
+			}
 		}
 	}
+
+	s.responsesM.Lock()
+	defer s.responsesM.Unlock()
+	for key, r := range s.responses {
+		if !r.expiresAt.After(now) {
+			delete(s.responses, key)
+		}
+	}
+	return purged, nil
+}
+
+// ReserveResponse marks key as taken by a request in flight until
+// expiresAt, unless a live record of key exists. It returns that record
+// and false in this case.
+func (s *MemoryStorage) ReserveResponse(ctx context.Context, key, requestHash string, expiresAt time.Time) (dto.IdempotentResponse, bool, error) {
+	s.responsesM.Lock()
+	defer s.responsesM.Unlock()
+	if r, ok := s.responses[key]; ok && r.expiresAt.After(time.Now()) {
+		return r.resp, false, nil
+	}
+	s.responses[key] = idempotentRecord{resp: dto.IdempotentResponse{RequestHash: requestHash}, expiresAt: expiresAt}
+	return dto.IdempotentResponse{}, true, nil
+}
+
+// SaveResponse keeps resp of the request that reserved key until expiresAt.
+func (s *MemoryStorage) SaveResponse(ctx context.Context, key string, resp dto.IdempotentResponse, expiresAt time.Time) error {
+	s.responsesM.Lock()
+	defer s.responsesM.Unlock()
+	s.responses[key] = idempotentRecord{resp: resp, expiresAt: expiresAt}
+	return nil
+}
+
+// ReleaseResponse forgets a reservation of key, so that the request can
+// be retried.
+func (s *MemoryStorage) ReleaseResponse(ctx context.Context, key string) error {
+	s.responsesM.Lock()
+	defer s.responsesM.Unlock()
+	if r, ok := s.responses[key]; ok && r.resp.InFlight() {
+		delete(s.responses, key)
+	}
+	return nil
+}
+
+func (s *MemoryStorage) StoreClicks(ctx context.Context, clicks []dto.Click) error {
+	s.clicks.add(clicks...)
 	return nil
 }
 
-func (s *MemoryStorage) Get(ctx context.Context, id string) (string, error) {
-	s.m.RLock()
-	defer s.m.RUnlock()
-	return s.storage[id], nil
+func (s *MemoryStorage) GetOwner(ctx context.Context, id string) (string, error) {
+	sh := s.shard(id)
+	sh.m.RLock()
+	defer sh.m.RUnlock()
+	r, ok := sh.storage[id]
+	if !ok {
+		return "", storage.ErrNotFound
+	}
+	return r.userID, nil
+}
+
+func (s *MemoryStorage) ClickStats(ctx context.Context, alias string, from, to time.Time, top int) (dto.LinkStats, error) {
+	return s.clicks.stats(alias, from, to, top), nil
+}
+
+// Stats reports the memory taken by stored links. Clicks and idempotent
+// responses are kept in bounded or expiring structures and not counted.
+func (s *MemoryStorage) Stats() dto.MemoryStats {
+	links := 0
+	for _, sh := range s.shards {
+		sh.m.RLock()
+		links += len(sh.storage)
+		sh.m.RUnlock()
+	}
+	return dto.MemoryStats{
+		UsedBytes:  s.usedBytes.Load(),
+		PeakBytes:  s.peakBytes.Load(),
+		LimitBytes: s.maxStorageSize,
+		Links:      links,
+	}
 }
 
 func (s *MemoryStorage) Ping(ctx context.Context) error {
@@ -72,20 +483,201 @@ func (s *MemoryStorage) Close(ctx context.Context) error {
 	return nil
 }
 
-func (s *MemoryStorage) isIDExists(id string) bool {
-	_, e := s.storage[id]
-	return e
+// shard returns the shard owning key, be it an alias, a long URL or a user.
+func (s *MemoryStorage) shard(key string) *shard {
+	return s.shards[s.shardIndex(key)]
+}
+
+func (s *MemoryStorage) shardIndex(key string) int {
+	// FNV-1a, inlined to avoid allocating a hash.Hash per lookup.
+	h := uint32(2166136261)
+	for i := 0; i < len(key); i++ {
+		h ^= uint32(key[i])
+		h *= 16777619
+	}
+	return int(h % uint32(len(s.shards)))
+}
+
+// lock write-locks the shards owning keys. Shards are always locked in the
+// same order, so operations spanning several shards cannot deadlock.
+func (s *MemoryStorage) lock(keys ...string) (unlock func()) {
+	indexes := make([]int, 0, len(keys))
+	for _, key := range keys {
+		indexes = append(indexes, s.shardIndex(key))
+	}
+	sort.Ints(indexes)
+
+	locked := make([]*shard, 0, len(indexes))
+	for i, idx := range indexes {
+		if i > 0 && idx == indexes[i-1] {
+			continue
+		}
+		sh := s.shards[idx]
+		sh.m.Lock()
+		locked = append(locked, sh)
+	}
+	return func() {
+		for i := len(locked) - 1; i >= 0; i-- {
+			locked[i].m.Unlock()
+		}
+	}
+}
+
+func (s *MemoryStorage) aliasOf(value string) (string, bool) {
+	sh := s.shard(value)
+	sh.m.RLock()
+	defer sh.m.RUnlock()
+	alias, ok := sh.uniqueValueConstraint[value]
+	return alias, ok
+}
+
+// reserve accounts size bytes if they fit within the limit.
+func (s *MemoryStorage) reserve(size uint64) bool {
+	for {
+		used := s.usedBytes.Load()
+		if s.maxStorageSize != 0 && used+size > s.maxStorageSize {
+			return false
+		}
+		if s.usedBytes.CompareAndSwap(used, used+size) {
+			s.raisePeak(used + size)
+			return true
+		}
+	}
+}
+
+func (s *MemoryStorage) release(size uint64) {
+	for {
+		used := s.usedBytes.Load()
+		if s.usedBytes.CompareAndSwap(used, used-min(size, used)) {
+			return
+		}
+	}
+}
+
+func (s *MemoryStorage) raisePeak(used uint64) {
+	for {
+		peak := s.peakBytes.Load()
+		if used <= peak || s.peakBytes.CompareAndSwap(peak, used) {
+			return
+		}
+	}
+}
+
+// retire turns the link id into a tombstone if it has expired, so that its
+// long URL can be stored again while the alias goes on answering as gone,
+// the way it does in Postgres.
+func (s *MemoryStorage) retire(id string) {
+	s.bury(id, func(r record) bool { return r.isExpired(time.Now()) })
+}
+
+// bury turns the link id into a tombstone, if match reports true for it,
+// taking its value out of uniqueValueConstraint.
+func (s *MemoryStorage) bury(id string, match func(record) bool) {
+	sh := s.shard(id)
+	for {
+		sh.m.RLock()
+		seen, ok := sh.storage[id]
+		sh.m.RUnlock()
+		if !ok || seen.deleted || !match(seen) {
+			return
+		}
+
+		unlock := s.lock(id, seen.value)
+		r, ok := sh.storage[id]
+		if ok && r.value != seen.value {
+			// The link has been replaced and another shard has to be locked.
+			unlock()
+			continue
+		}
+		if !ok || r.deleted || !match(r) {
+			unlock()
+			return
+		}
+		values := s.shard(r.value).uniqueValueConstraint
+		if values[r.value] == id {
+			delete(values, r.value)
+		}
+		s.release(s.linkSize(id, r.value, r.userID) - s.tombstoneSize(id, r.userID))
+		sh.storage[id] = record{userID: r.userID, deleted: true, expiresAt: r.expiresAt}
+		unlock()
+		return
+	}
+}
+
+func (s *MemoryStorage) removeIfExpired(id string) bool {
+	_, ok := s.removeLink(id, func(r record) bool { return r.isExpired(time.Now()) })
+	return ok
 }
 
-func (s *MemoryStorage) isValueExists(value string) bool {
-	_, e := s.uniqueValueConstraint[value]
-	return e
+// rollback removes the rows created by a partially stored batch.
+func (s *MemoryStorage) rollback(stored []storage.BatchResult) {
+	for _, row := range stored {
+		if row.Existing || row.Err != nil {
+			continue
+		}
+		s.removeLink(row.Alias, nil)
+	}
+}
+
+// removeLink removes the link id, if match is nil or reports true for it,
+// and returns the removed record.
+func (s *MemoryStorage) removeLink(id string, match func(record) bool) (record, bool) {
+	sh := s.shard(id)
+	for {
+		sh.m.RLock()
+		seen, ok := sh.storage[id]
+		sh.m.RUnlock()
+		if !ok || (match != nil && !match(seen)) {
+			return record{}, false
+		}
+
+		unlock := s.lock(id, seen.value, seen.userID)
+		r, ok := sh.storage[id]
+		if ok && (r.value != seen.value || r.userID != seen.userID) {
+			// The link has been replaced and other shards have to be locked.
+			unlock()
+			continue
+		}
+		if !ok || (match != nil && !match(r)) {
+			unlock()
+			return record{}, false
+		}
+		s.remove(id, r)
+		unlock()
+		return r, true
+	}
 }
 
-func (s *MemoryStorage) updateSize(newRow ...string) {
-	var size uint64
-	for _, s := range newRow {
-		size += (uint64(len(s)) + stringOverhead) * 2
+// remove expects the shards of id, r.value and r.userID to be locked.
+func (s *MemoryStorage) remove(id string, r record) {
+	users := s.shard(r.userID).userIndex
+	size := s.linkSize(id, r.value, r.userID)
+	if r.deleted {
+		size = s.tombstoneSize(id, r.userID)
+	}
+	if aliases := users[r.userID]; len(aliases) == 1 && aliases[0] == id {
+		size += userSize()
+	}
+
+	delete(s.shard(id).storage, id)
+	if s.evictor != nil {
+		s.evictor.remove(id)
 	}
-	s.currentBytesSize += size
+	values := s.shard(r.value).uniqueValueConstraint
+	if values[r.value] == id {
+		delete(values, r.value)
+	}
+	if aliases, ok := users[r.userID]; ok {
+		for i, alias := range aliases {
+			if alias == id {
+				users[r.userID] = append(aliases[:i], aliases[i+1:]...)
+				break
+			}
+		}
+		if len(users[r.userID]) == 0 {
+			delete(users, r.userID)
+		}
+	}
+
+	s.release(size)
 }
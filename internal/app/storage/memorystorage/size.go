@@ -0,0 +1,49 @@
+package memorystorage
+
+import (
+	"container/list"
+	"unsafe"
+)
+
+var (
+	stringHeaderSize = uint64(unsafe.Sizeof(""))
+	sliceHeaderSize  = uint64(unsafe.Sizeof([]string(nil)))
+	recordSize       = uint64(unsafe.Sizeof(record{}))
+	listElementSize  = uint64(unsafe.Sizeof(list.Element{}))
+	pointerSize      = uint64(unsafe.Sizeof(uintptr(0)))
+)
+
+// mapEntrySize estimates the memory a map entry takes: the key and value
+// slots, a control byte, and the slack left by the 7/8 maximum load factor
+// of Go maps.
+func mapEntrySize(keySize, valueSize uint64) uint64 {
+	return (keySize + valueSize + 1) * 8 / 7
+}
+
+// linkSize returns the memory taken by a stored link, its string data
+// included, across storage, uniqueValueConstraint, userIndex and the
+// evictor. Strings shared between the maps are counted once.
+func (s *MemoryStorage) linkSize(id, value, userID string) uint64 {
+	size := uint64(len(id) + len(value) + len(userID))
+	size += mapEntrySize(stringHeaderSize, recordSize)
+	size += mapEntrySize(stringHeaderSize, stringHeaderSize)
+	if userID != "" {
+		size += stringHeaderSize
+	}
+	if s.evictor != nil {
+		// A list element and its entry in the index of the evictor.
+		size += listElementSize + mapEntrySize(stringHeaderSize, pointerSize)
+	}
+	return size
+}
+
+// tombstoneSize returns the memory taken by a deleted link, which keeps no
+// value and has no entry in uniqueValueConstraint.
+func (s *MemoryStorage) tombstoneSize(id, userID string) uint64 {
+	return s.linkSize(id, "", userID) - mapEntrySize(stringHeaderSize, stringHeaderSize)
+}
+
+// userSize returns the memory taken by the userIndex entry of a user.
+func userSize() uint64 {
+	return mapEntrySize(stringHeaderSize, sliceHeaderSize)
+}
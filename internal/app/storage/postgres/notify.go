@@ -0,0 +1,108 @@
+package postgres
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+const (
+	changesChannel = "shorten_url_changes"
+	// maxNotifyPayload keeps payloads below the 8000 bytes NOTIFY accepts.
+	maxNotifyPayload = 7900
+
+	minListenRetryDelay = time.Second
+	maxListenRetryDelay = 30 * time.Second
+)
+
+type execer interface {
+	Exec(ctx context.Context, sql string, arguments ...any) (pgconn.CommandTag, error)
+}
+
+// notifyChanges publishes changed aliases on changesChannel as comma
+// separated payloads. Aliases never contain commas.
+func notifyChanges(ctx context.Context, db execer, aliases []string) error {
+	var payload strings.Builder
+	flush := func() error {
+		if payload.Len() == 0 {
+			return nil
+		}
+		_, err := db.Exec(ctx, "SELECT pg_notify($1, $2)", changesChannel, payload.String())
+		payload.Reset()
+		return err
+	}
+
+	for _, alias := range aliases {
+		if payload.Len()+len(alias)+1 > maxNotifyPayload {
+			if err := flush(); err != nil {
+				return err
+			}
+		}
+		if payload.Len() > 0 {
+			payload.WriteByte(',')
+		}
+		payload.WriteString(alias)
+	}
+	return flush()
+}
+
+// publishChanges notifies other instances about changes that have already
+// been made. A failure is only logged since the change itself succeeded.
+func (s *PostgresStorage) publishChanges(ctx context.Context, aliases []string) {
+	if len(aliases) == 0 {
+		return
+	}
+	if err := notifyChanges(ctx, s.db, aliases); err != nil {
+		s.log.Errorf("failed to publish changes: %s", err)
+	}
+}
+
+// Listen calls onChange with aliases changed by any instance until ctx is
+// done. The connection is re-established whenever it is lost, and onReset
+// is called every time listening starts, since notifications sent while
+// disconnected are not delivered.
+func (s *PostgresStorage) Listen(ctx context.Context, onChange func(aliases []string), onReset func()) {
+	delay := minListenRetryDelay
+	for {
+		err := s.listen(ctx, onChange, func() {
+			delay = minListenRetryDelay
+			onReset()
+		})
+		if ctx.Err() != nil {
+			return
+		}
+		s.log.Errorf("stopped listening for changes, retrying in %s: %s", delay, err)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(delay):
+		}
+		delay = min(delay*2, maxListenRetryDelay)
+	}
+}
+
+func (s *PostgresStorage) listen(ctx context.Context, onChange func(aliases []string), onListening func()) error {
+	conn, err := s.db.Acquire(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Release()
+	// A listening connection must not be handed out by the pool again.
+	defer conn.Conn().Close(context.Background())
+
+	if _, err := conn.Exec(ctx, "LISTEN "+changesChannel); err != nil {
+		return err
+	}
+	onListening()
+
+	for {
+		n, err := conn.Conn().WaitForNotification(ctx)
+		if err != nil {
+			return err
+		}
+		onChange(strings.Split(n.Payload, ","))
+	}
+}
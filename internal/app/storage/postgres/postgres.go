@@ -2,37 +2,120 @@ package postgres
 
 import (
 	"context"
-	"database/sql"
+	"errors"
 	"fmt"
 	"log"
-	"strings"
+	"time"
 
 	"github.com/DeneesK/short-url/internal/app/dto"
 	"github.com/DeneesK/short-url/internal/app/storage"
 	"github.com/golang-migrate/migrate/v4"
 	_ "github.com/golang-migrate/migrate/v4/database/postgres"
 	_ "github.com/golang-migrate/migrate/v4/source/file"
-	_ "github.com/jackc/pgx/v5/stdlib"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"go.uber.org/zap"
 )
 
+const (
+	uniqueViolationCode   = "23505"
+	aliasUniqueConstraint = "shorten_url_alias_key"
+)
+
+// Names of statements prepared on every pooled connection.
+const (
+	stmtRetire  = "retire_url"
+	stmtStore   = "store_url"
+	stmtAliasOf = "alias_of_url"
+	stmtGet     = "get_url"
+)
+
+// A long URL is unique among the rows that are not deleted only, so rows
+// that are dead keep their alias, which goes on answering as gone, when
+// the long URL is shortened again. stmtRetire marks an expired row of a
+// long URL as deleted to make way for a new one, and stmtStore returns no
+// rows when a live one exists.
+var preparedStatements = map[string]string{
+	stmtRetire: `UPDATE shorten_url SET is_deleted = TRUE
+		WHERE long_url = $1 AND NOT is_deleted AND expires_at <= now()
+		RETURNING alias`,
+	stmtStore: `INSERT INTO shorten_url (alias, long_url, user_id, expires_at) VALUES ($1, $2, $3, $4)
+		ON CONFLICT (long_url) WHERE NOT is_deleted DO NOTHING
+		RETURNING alias`,
+	stmtAliasOf: "SELECT alias FROM shorten_url WHERE long_url = $1 AND NOT is_deleted",
+	stmtGet:     "SELECT long_url, is_deleted, expires_at FROM shorten_url WHERE alias = $1",
+}
+
+// PoolConfig tunes the connection pool. Zero values keep pgxpool defaults.
+type PoolConfig struct {
+	MaxConns          int32
+	MinConns          int32
+	MaxConnLifetime   time.Duration
+	HealthCheckPeriod time.Duration
+}
+
+// Logger reports failures that do not fail the call they happen in.
+type Logger interface {
+	Errorf(template string, args ...interface{})
+}
+
 type PostgresStorage struct {
-	db *sql.DB
+	db  *pgxpool.Pool
+	log Logger
 }
 
 type Option func(*PostgresStorage) error
 
-func NewDBConnection(ctx context.Context, dbDSN string, opts ...Option) *PostgresStorage {
-	db, err := sql.Open("pgx", dbDSN)
-	if err != nil {
-		log.Fatalf("Unable to connect to database: %v", err)
+// WithLogger reports failures to publish and listen for changes to log.
+func WithLogger(log Logger) Option {
+	return func(s *PostgresStorage) error {
+		s.log = log
+		return nil
 	}
-	s := &PostgresStorage{db: db}
+}
+
+// NewDBConnection applies opts before the pool is opened, so that
+// migrations are in place by the time statements get prepared.
+func NewDBConnection(ctx context.Context, dbDSN string, poolConf PoolConfig, opts ...Option) *PostgresStorage {
+	s := &PostgresStorage{log: zap.NewNop().Sugar()}
 	for _, opt := range opts {
 		err := opt(s)
 		if err != nil {
 			log.Fatalf("Unable to apply option: %v", err)
 		}
 	}
+
+	cfg, err := pgxpool.ParseConfig(dbDSN)
+	if err != nil {
+		log.Fatalf("Unable to parse database dsn: %v", err)
+	}
+	if poolConf.MaxConns > 0 {
+		cfg.MaxConns = poolConf.MaxConns
+	}
+	if poolConf.MinConns > 0 {
+		cfg.MinConns = poolConf.MinConns
+	}
+	if poolConf.MaxConnLifetime > 0 {
+		cfg.MaxConnLifetime = poolConf.MaxConnLifetime
+	}
+	if poolConf.HealthCheckPeriod > 0 {
+		cfg.HealthCheckPeriod = poolConf.HealthCheckPeriod
+	}
+	cfg.AfterConnect = func(ctx context.Context, conn *pgx.Conn) error {
+		for name, query := range preparedStatements {
+			if _, err := conn.Prepare(ctx, name, query); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	db, err := pgxpool.NewWithConfig(ctx, cfg)
+	if err != nil {
+		log.Fatalf("Unable to connect to database: %v", err)
+	}
+	s.db = db
 	return s
 }
 
@@ -52,73 +135,395 @@ func RunMigrations(migrationSource, dbDSN string) Option {
 	}
 }
 
-func (s *PostgresStorage) Store(ctx context.Context, id, value string) (string, error) {
-	query := "INSERT INTO shorten_url (alias, long_url) VALUES ($1, $2) ON CONFLICT (long_url) DO UPDATE SET alias = shorten_url.alias RETURNING alias"
-	var alias string
+// Store stores value under id. An expired row of the same value is marked
+// as deleted in the same transaction, so that its alias is still known.
+func (s *PostgresStorage) Store(ctx context.Context, id, value, userID string, expiresAt *time.Time) (string, error) {
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback(ctx)
 
-	err := s.db.QueryRowContext(ctx, query, id, value).Scan(&alias)
+	rows, err := tx.Query(ctx, stmtRetire, value)
+	if err != nil {
+		return "", err
+	}
+	retired, err := pgx.CollectRows(rows, pgx.RowTo[string])
 	if err != nil {
 		return "", err
 	}
 
+	var alias string
+	err = tx.QueryRow(ctx, stmtStore, id, value, userID, expiresAt).Scan(&alias)
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) && pgErr.Code == uniqueViolationCode && pgErr.ConstraintName == aliasUniqueConstraint {
+		return "", storage.ErrNotUniqueID
+	} else if errors.Is(err, pgx.ErrNoRows) {
+		// The long URL is stored under a live alias already.
+		if err := tx.QueryRow(ctx, stmtAliasOf, value).Scan(&alias); err != nil {
+			return "", err
+		}
+	} else if err != nil {
+		return "", err
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return "", err
+	}
+
 	if alias != id {
+		s.publishChanges(ctx, retired)
 		return alias, storage.ErrUniqueViolation
 	}
 
+	s.publishChanges(ctx, append(retired, id))
 	return id, nil
 }
 
-func (s *PostgresStorage) StoreBatch(ctx context.Context, batch []dto.OriginalURL) error {
-	const chunkSize = 1000
+// StoreBatch copies batch into a temporary table and merges it into
+// shorten_url. Expired rows of the same long URLs are marked as deleted,
+// and dead rows are left in place next to the new ones. Rows whose long URL
+// is already stored under a live alias, either before
+// or earlier in the same batch, are reported as existing with the stored alias.
+// Rows whose alias belongs to another URL are reported with ErrNotUniqueID,
+// or abort the whole batch when atomic is set.
+func (s *PostgresStorage) StoreBatch(ctx context.Context, batch []dto.OriginalURL, userID string, atomic bool) ([]storage.BatchResult, error) {
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(ctx)
 
-	tx, err := s.db.Begin()
+	_, err = tx.Exec(ctx, `CREATE TEMP TABLE batch_urls (
+		ord INT NOT NULL,
+		alias TEXT NOT NULL,
+		long_url TEXT NOT NULL,
+		user_id TEXT NOT NULL,
+		expires_at TIMESTAMPTZ
+	) ON COMMIT DROP`)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	defer tx.Rollback()
 
-	for i := 0; i < len(batch); i += chunkSize {
-		end := i + chunkSize
-		if end > len(batch) {
-			end = len(batch)
-		}
+	_, err = tx.CopyFrom(ctx,
+		pgx.Identifier{"batch_urls"},
+		[]string{"ord", "alias", "long_url", "user_id", "expires_at"},
+		pgx.CopyFromSlice(len(batch), func(i int) ([]any, error) {
+			return []any{i, batch[i].Alias, batch[i].URL, userID, batch[i].ExpiresAt}, nil
+		}),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := tx.Query(ctx, `UPDATE shorten_url s SET is_deleted = TRUE
+		FROM batch_urls b
+		WHERE s.long_url = b.long_url AND NOT s.is_deleted AND s.expires_at <= now()
+		RETURNING s.alias`)
+	if err != nil {
+		return nil, err
+	}
+	retired, err := pgx.CollectRows(rows, pgx.RowTo[string])
+	if err != nil {
+		return nil, err
+	}
 
-		chunk := batch[i:end]
-		var queryBuilder strings.Builder
-		queryBuilder.WriteString("INSERT INTO shorten_url (alias, long_url) VALUES ")
+	rows, err = tx.Query(ctx, `INSERT INTO shorten_url (alias, long_url, user_id, expires_at)
+		SELECT DISTINCT ON (long_url) alias, long_url, user_id, expires_at
+		FROM batch_urls ORDER BY long_url, ord
+		ON CONFLICT DO NOTHING
+		RETURNING alias`)
+	if err != nil {
+		return nil, err
+	}
+	inserted, err := pgx.CollectRows(rows, pgx.RowTo[string])
+	if err != nil {
+		return nil, err
+	}
+	created := make(map[string]struct{}, len(inserted))
+	for _, alias := range inserted {
+		created[alias] = struct{}{}
+	}
 
-		params := []interface{}{}
-		for j, row := range chunk {
-			if j > 0 {
-				queryBuilder.WriteString(", ")
+	rows, err = tx.Query(ctx, `SELECT b.ord, s.alias FROM batch_urls b
+		LEFT JOIN shorten_url s ON s.long_url = b.long_url AND NOT s.is_deleted
+		ORDER BY b.ord`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	result := make([]storage.BatchResult, len(batch))
+	for rows.Next() {
+		var ord int
+		var alias *string
+		if err := rows.Scan(&ord, &alias); err != nil {
+			return nil, err
+		}
+		// The row was skipped because its alias belongs to another URL.
+		if alias == nil {
+			if atomic {
+				return nil, &storage.AliasError{Alias: batch[ord].Alias, Err: storage.ErrNotUniqueID}
 			}
-			queryBuilder.WriteString(fmt.Sprintf("($%d, $%d)", 2*j+1, 2*j+2))
-			params = append(params, row.ID, row.URL)
+			result[ord] = storage.BatchResult{ID: batch[ord].ID, Err: storage.ErrNotUniqueID}
+			continue
 		}
-
-		_, err = tx.ExecContext(ctx, queryBuilder.String(), params...)
-		if err != nil {
-			return err
+		_, isNew := created[*alias]
+		result[ord] = storage.BatchResult{
+			ID:       batch[ord].ID,
+			Alias:    *alias,
+			Existing: !isNew || *alias != batch[ord].Alias,
 		}
 	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if err := notifyChanges(ctx, tx, append(inserted, retired...)); err != nil {
+		return nil, err
+	}
 
-	return tx.Commit()
+	return result, tx.Commit(ctx)
 }
 
-func (s *PostgresStorage) Get(ctx context.Context, id string) (string, error) {
-	query := "SELECT long_url FROM shorten_url WHERE alias = $1"
+func (s *PostgresStorage) Get(ctx context.Context, id string) (storage.Link, error) {
 	var longURL string
-	err := s.db.QueryRowContext(ctx, query, id).Scan(&longURL)
+	var isDeleted bool
+	var expiresAt *time.Time
+	err := s.db.QueryRow(ctx, stmtGet, id).Scan(&longURL, &isDeleted, &expiresAt)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return storage.Link{}, storage.ErrNotFound
+	} else if err != nil {
+		return storage.Link{}, err
+	}
+	if isDeleted {
+		return storage.Link{}, storage.ErrDeleted
+	}
+	if expiresAt != nil && !expiresAt.After(time.Now()) {
+		return storage.Link{}, storage.ErrExpired
+	}
+	return storage.Link{Value: longURL, ExpiresAt: expiresAt}, nil
+}
+
+func (s *PostgresStorage) GetByUserID(ctx context.Context, userID string) ([]dto.UserURL, error) {
+	query := "SELECT alias, long_url FROM shorten_url WHERE user_id = $1 AND NOT is_deleted AND (expires_at IS NULL OR expires_at > now())"
+	rows, err := s.db.Query(ctx, query, userID)
 	if err != nil {
-		return "", err
+		return nil, err
+	}
+	defer rows.Close()
+
+	result := make([]dto.UserURL, 0)
+	for rows.Next() {
+		var u dto.UserURL
+		if err := rows.Scan(&u.ShortURL, &u.OriginalURL); err != nil {
+			return nil, err
+		}
+		result = append(result, u)
+	}
+	return result, rows.Err()
+}
+
+func (s *PostgresStorage) DeleteBatch(ctx context.Context, userID string, aliases []string) error {
+	query := "UPDATE shorten_url SET is_deleted = TRUE WHERE alias = ANY($1) AND user_id = $2 RETURNING alias"
+	rows, err := s.db.Query(ctx, query, aliases, userID)
+	if err != nil {
+		return err
+	}
+	deleted, err := pgx.CollectRows(rows, pgx.RowTo[string])
+	if err != nil {
+		return err
+	}
+	s.publishChanges(ctx, deleted)
+	return nil
+}
+
+func (s *PostgresStorage) PurgeExpired(ctx context.Context) (int, error) {
+	query := "DELETE FROM shorten_url WHERE expires_at <= now() RETURNING alias"
+	rows, err := s.db.Query(ctx, query)
+	if err != nil {
+		return 0, err
+	}
+	purged, err := pgx.CollectRows(rows, pgx.RowTo[string])
+	if err != nil {
+		return 0, err
+	}
+	s.publishChanges(ctx, purged)
+
+	_, err = s.db.Exec(ctx, "DELETE FROM idempotency_keys WHERE expires_at <= now()")
+	if err != nil {
+		return 0, err
+	}
+	return len(purged), nil
+}
+
+// ReserveResponse marks key as taken by a request in flight until
+// expiresAt, unless a live record of key exists. It returns that record
+// and false in this case. A record in flight has no status code.
+func (s *PostgresStorage) ReserveResponse(ctx context.Context, key, requestHash string, expiresAt time.Time) (dto.IdempotentResponse, bool, error) {
+	reserve := `INSERT INTO idempotency_keys (key, request_hash, status_code, body, expires_at)
+		VALUES ($1, $2, 0, '', $3)
+		ON CONFLICT (key) DO UPDATE SET
+			request_hash = EXCLUDED.request_hash,
+			status_code = 0,
+			content_type = '',
+			body = '',
+			expires_at = EXCLUDED.expires_at
+		WHERE idempotency_keys.expires_at <= now()
+		RETURNING key`
+	err := s.db.QueryRow(ctx, reserve, key, requestHash, expiresAt).Scan(&key)
+	if err == nil {
+		return dto.IdempotentResponse{}, true, nil
+	} else if !errors.Is(err, pgx.ErrNoRows) {
+		return dto.IdempotentResponse{}, false, err
+	}
+
+	query := `SELECT request_hash, status_code, content_type, body FROM idempotency_keys
+		WHERE key = $1`
+	var resp dto.IdempotentResponse
+	err = s.db.QueryRow(ctx, query, key).Scan(&resp.RequestHash, &resp.StatusCode, &resp.ContentType, &resp.Body)
+	if errors.Is(err, pgx.ErrNoRows) {
+		// The record has been released meanwhile; report it as in flight,
+		// so that the client retries.
+		return dto.IdempotentResponse{RequestHash: requestHash}, false, nil
+	} else if err != nil {
+		return dto.IdempotentResponse{}, false, err
+	}
+	return resp, false, nil
+}
+
+// SaveResponse keeps resp of the request that reserved key until expiresAt.
+func (s *PostgresStorage) SaveResponse(ctx context.Context, key string, resp dto.IdempotentResponse, expiresAt time.Time) error {
+	query := `INSERT INTO idempotency_keys (key, request_hash, status_code, content_type, body, expires_at)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		ON CONFLICT (key) DO UPDATE SET
+			request_hash = EXCLUDED.request_hash,
+			status_code = EXCLUDED.status_code,
+			content_type = EXCLUDED.content_type,
+			body = EXCLUDED.body,
+			expires_at = EXCLUDED.expires_at`
+	_, err := s.db.Exec(ctx, query, key, resp.RequestHash, resp.StatusCode, resp.ContentType, resp.Body, expiresAt)
+	return err
+}
+
+// ReleaseResponse forgets a reservation of key, so that the request can
+// be retried.
+func (s *PostgresStorage) ReleaseResponse(ctx context.Context, key string) error {
+	_, err := s.db.Exec(ctx, "DELETE FROM idempotency_keys WHERE key = $1 AND status_code = 0", key)
+	return err
+}
+
+func (s *PostgresStorage) StoreClicks(ctx context.Context, clicks []dto.Click) error {
+	query := `INSERT INTO clicks (alias, clicked_at, referrer, user_agent, ip)
+		SELECT * FROM unnest($1::text[], $2::timestamptz[], $3::text[], $4::text[], $5::text[])`
+
+	aliases := make([]string, len(clicks))
+	clickedAt := make([]time.Time, len(clicks))
+	referrers := make([]string, len(clicks))
+	userAgents := make([]string, len(clicks))
+	ips := make([]string, len(clicks))
+	for i, c := range clicks {
+		aliases[i] = c.Alias
+		clickedAt[i] = c.ClickedAt
+		referrers[i] = c.Referrer
+		userAgents[i] = c.UserAgent
+		ips[i] = c.IP
+	}
+
+	_, err := s.db.Exec(ctx, query, aliases, clickedAt, referrers, userAgents, ips)
+	return err
+}
+
+func (s *PostgresStorage) GetOwner(ctx context.Context, id string) (string, error) {
+	query := "SELECT user_id FROM shorten_url WHERE alias = $1"
+	var userID string
+	err := s.db.QueryRow(ctx, query, id).Scan(&userID)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return "", storage.ErrNotFound
+	}
+	return userID, err
+}
+
+func (s *PostgresStorage) ClickStats(ctx context.Context, alias string, from, to time.Time, top int) (dto.LinkStats, error) {
+	result := dto.LinkStats{Alias: alias, From: from, To: to}
+
+	query := `SELECT count(*), count(DISTINCT ip) FROM clicks
+		WHERE alias = $1 AND clicked_at >= $2 AND clicked_at < $3`
+	err := s.db.QueryRow(ctx, query, alias, from, to).Scan(&result.TotalClicks, &result.UniqueVisitors)
+	if err != nil {
+		return result, err
+	}
+
+	query = `SELECT to_char(clicked_at AT TIME ZONE 'UTC', 'YYYY-MM-DD') AS day, count(*) FROM clicks
+		WHERE alias = $1 AND clicked_at >= $2 AND clicked_at < $3
+		GROUP BY day ORDER BY day`
+	rows, err := s.db.Query(ctx, query, alias, from, to)
+	if err != nil {
+		return result, err
+	}
+	defer rows.Close()
+	result.ClicksPerDay = make([]dto.DailyClicks, 0)
+	for rows.Next() {
+		var d dto.DailyClicks
+		if err := rows.Scan(&d.Date, &d.Clicks); err != nil {
+			return result, err
+		}
+		result.ClicksPerDay = append(result.ClicksPerDay, d)
+	}
+	if err := rows.Err(); err != nil {
+		return result, err
+	}
+
+	result.TopReferrers, err = s.topClickValues(ctx, "referrer", alias, from, to, top)
+	if err != nil {
+		return result, err
+	}
+	result.TopUserAgents, err = s.topClickValues(ctx, "user_agent", alias, from, to, top)
+	return result, err
+}
+
+// topClickValues counts the most frequent values of column, which must be
+// a trusted column name of the clicks table.
+func (s *PostgresStorage) topClickValues(ctx context.Context, column, alias string, from, to time.Time, top int) ([]dto.CountedValue, error) {
+	query := fmt.Sprintf(`SELECT %[1]s, count(*) AS cnt FROM clicks
+		WHERE alias = $1 AND clicked_at >= $2 AND clicked_at < $3 AND %[1]s <> ''
+		GROUP BY %[1]s ORDER BY cnt DESC, %[1]s LIMIT $4`, column)
+	rows, err := s.db.Query(ctx, query, alias, from, to, top)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	result := make([]dto.CountedValue, 0)
+	for rows.Next() {
+		var v dto.CountedValue
+		if err := rows.Scan(&v.Value, &v.Count); err != nil {
+			return nil, err
+		}
+		result = append(result, v)
+	}
+	return result, rows.Err()
+}
+
+func (s *PostgresStorage) PoolStats() dto.PoolStats {
+	stat := s.db.Stat()
+	return dto.PoolStats{
+		TotalConns:           stat.TotalConns(),
+		IdleConns:            stat.IdleConns(),
+		AcquiredConns:        stat.AcquiredConns(),
+		ConstructingConns:    stat.ConstructingConns(),
+		MaxConns:             stat.MaxConns(),
+		AcquireCount:         stat.AcquireCount(),
+		EmptyAcquireCount:    stat.EmptyAcquireCount(),
+		CanceledAcquireCount: stat.CanceledAcquireCount(),
+		AcquireDuration:      stat.AcquireDuration().String(),
+		NewConnsCount:        stat.NewConnsCount(),
 	}
-	return longURL, nil
 }
 
 func (s *PostgresStorage) Ping(ctx context.Context) error {
-	return s.db.Ping()
+	return s.db.Ping(ctx)
 }
 
 func (s *PostgresStorage) Close(ctx context.Context) error {
-	return s.db.Close()
+	s.db.Close()
+	return nil
 }
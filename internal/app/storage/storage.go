@@ -1,7 +1,45 @@
 package storage
 
-import "errors"
+import (
+	"errors"
+	"fmt"
+	"time"
+)
 
 var ErrNotUniqueID = errors.New("a record with this ID already exists")
 var ErrUniqueViolation = errors.New("a record with this value already exists")
 var ErrStorageLimitExceeded = errors.New("storage limit exceeded")
+var ErrDeleted = errors.New("a record has been deleted")
+var ErrExpired = errors.New("a record has expired")
+var ErrNotFound = errors.New("a record not found")
+var ErrCompactionUnsupported = errors.New("the storage cannot be compacted")
+
+// Link is a stored long URL together with its expiration time, if any.
+type Link struct {
+	Value     string
+	ExpiresAt *time.Time
+}
+
+// AliasError is the error of an atomic batch rejected because of the row
+// stored under Alias.
+type AliasError struct {
+	Alias string
+	Err   error
+}
+
+func (e *AliasError) Error() string {
+	return fmt.Sprintf("%v: %q", e.Err, e.Alias)
+}
+
+func (e *AliasError) Unwrap() error {
+	return e.Err
+}
+
+// BatchResult describes how a single row of a batch has been stored.
+// Err is set when the row has been rejected and nothing was stored for it.
+type BatchResult struct {
+	ID       string
+	Alias    string
+	Existing bool
+	Err      error
+}
@@ -0,0 +1,305 @@
+// Package wal implements an append-only log of length-prefixed, checksummed
+// records.
+//
+// Every record is laid out as a 4 byte big-endian payload length, a 4 byte
+// big-endian CRC-32C of the payload, a 4 byte big-endian CRC-32C of the
+// preceding 8 bytes and the payload itself. The header is checked on its
+// own, so a corrupt length is never mistaken for a record torn by the end
+// of the log. Logs written
+// before the format was introduced consist of JSON lines; such lines are
+// still accepted by Replay, even when followed by records.
+package wal
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	filePerm   = 0600
+	headerSize = 12
+	// MaxRecordSize bounds a payload, so a corrupt length is not mistaken
+	// for a huge record.
+	MaxRecordSize = 16 << 20
+	// legacyRecordStart starts every JSON line of the former format and
+	// can never start a record, whose first byte is 0 below MaxRecordSize.
+	legacyRecordStart = '{'
+)
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+var ErrRecordTooLarge = errors.New("record is too large")
+
+// SyncPolicy tells when appended records are fsynced. The zero value
+// syncs after every record.
+type SyncPolicy struct {
+	// Interval between fsyncs; zero syncs after every record.
+	Interval time.Duration
+	// Never leaves syncing to the operating system.
+	Never bool
+}
+
+var (
+	SyncAlways = SyncPolicy{}
+	SyncNever  = SyncPolicy{Never: true}
+)
+
+// SyncEvery syncs appended records at most every interval.
+func SyncEvery(interval time.Duration) SyncPolicy {
+	return SyncPolicy{Interval: interval}
+}
+
+// ParseSyncPolicy accepts "always", "never" or an interval such as "100ms".
+func ParseSyncPolicy(policy string) (SyncPolicy, error) {
+	switch strings.ToLower(policy) {
+	case "", "always":
+		return SyncAlways, nil
+	case "never":
+		return SyncNever, nil
+	}
+	interval, err := time.ParseDuration(policy)
+	if err != nil || interval <= 0 {
+		return SyncPolicy{}, fmt.Errorf("invalid sync policy %q", policy)
+	}
+	return SyncEvery(interval), nil
+}
+
+// Writer appends records to a log file.
+type Writer struct {
+	m      sync.Mutex
+	file   *os.File
+	buf    *bufio.Writer
+	policy SyncPolicy
+	dirty  bool
+	stop   chan struct{}
+	done   chan struct{}
+}
+
+// OpenWriter opens the log at path for appending, creating it if needed.
+// The log is made readable by its owner only, even if it exists already.
+func OpenWriter(path string, policy SyncPolicy) (*Writer, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, filePerm)
+	if err != nil {
+		return nil, err
+	}
+	if err := file.Chmod(filePerm); err != nil {
+		file.Close()
+		return nil, err
+	}
+	w := &Writer{file: file, buf: bufio.NewWriter(file), policy: policy}
+	if !policy.Never && policy.Interval > 0 {
+		w.stop = make(chan struct{})
+		w.done = make(chan struct{})
+		go w.syncLoop()
+	}
+	return w, nil
+}
+
+// Append writes payload as a single record. The record reaches the
+// operating system before Append returns and the disk according to the
+// sync policy.
+func (w *Writer) Append(payload []byte) error {
+	if len(payload) > MaxRecordSize {
+		return ErrRecordTooLarge
+	}
+	var header [headerSize]byte
+	binary.BigEndian.PutUint32(header[:4], uint32(len(payload)))
+	binary.BigEndian.PutUint32(header[4:8], crc32.Checksum(payload, crcTable))
+	binary.BigEndian.PutUint32(header[8:], crc32.Checksum(header[:8], crcTable))
+
+	w.m.Lock()
+	defer w.m.Unlock()
+	if _, err := w.buf.Write(header[:]); err != nil {
+		return err
+	}
+	if _, err := w.buf.Write(payload); err != nil {
+		return err
+	}
+	if err := w.buf.Flush(); err != nil {
+		return err
+	}
+	if w.policy.Never {
+		return nil
+	}
+	if w.policy.Interval > 0 {
+		w.dirty = true
+		return nil
+	}
+	return w.file.Sync()
+}
+
+// Size returns the size of the log file.
+func (w *Writer) Size() (int64, error) {
+	info, err := w.file.Stat()
+	if err != nil {
+		return 0, err
+	}
+	return info.Size(), nil
+}
+
+// Close syncs and closes the log.
+func (w *Writer) Close() error {
+	if w.stop != nil {
+		close(w.stop)
+		<-w.done
+	}
+	w.m.Lock()
+	defer w.m.Unlock()
+	if err := w.buf.Flush(); err != nil {
+		w.file.Close()
+		return err
+	}
+	if err := w.file.Sync(); err != nil {
+		w.file.Close()
+		return err
+	}
+	return w.file.Close()
+}
+
+func (w *Writer) syncLoop() {
+	defer close(w.done)
+	ticker := time.NewTicker(w.policy.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-w.stop:
+			return
+		case <-ticker.C:
+			w.m.Lock()
+			if w.dirty {
+				// A failed sync is retried on the next tick and on Close.
+				if err := w.file.Sync(); err == nil {
+					w.dirty = false
+				}
+			}
+			w.m.Unlock()
+		}
+	}
+}
+
+// Replay calls fn with the payload of every record of the log at path. A
+// torn record at the end of the log, left by a crash in the middle of a
+// write, is truncated and the number of bytes cut off is returned. A
+// record with a corrupt header, or a corrupt payload followed by more
+// data, is not a torn write, so Replay fails with ErrCorrupt instead of
+// discarding the rest of the log. A missing log is empty.
+func Replay(path string, fn func(payload []byte) error) (int64, error) {
+	file, err := os.OpenFile(path, os.O_RDWR, filePerm)
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return 0, err
+	}
+
+	r := bufio.NewReader(file)
+	var offset int64
+	for {
+		payload, n, err := readRecord(r)
+		if errors.Is(err, io.EOF) {
+			return 0, nil
+		} else if errors.Is(err, errCorruptHeader) || errors.Is(err, errCorrupt) && offset+n < info.Size() {
+			return 0, fmt.Errorf("%w at offset %d", ErrCorrupt, offset)
+		} else if errors.Is(err, errTorn) || errors.Is(err, errCorrupt) {
+			if err := file.Truncate(offset); err != nil {
+				return 0, err
+			}
+			return info.Size() - offset, file.Sync()
+		} else if err != nil {
+			return 0, err
+		}
+		if err := fn(payload); err != nil {
+			return 0, err
+		}
+		offset += n
+	}
+}
+
+// ErrCorrupt is returned by Replay for a corrupt record in the middle of
+// the log.
+var ErrCorrupt = errors.New("corrupt log record")
+
+var (
+	errTorn          = errors.New("torn record")
+	errCorrupt       = errors.New("corrupt record")
+	errCorruptHeader = errors.New("corrupt record header")
+)
+
+// readRecord reads the next record and returns its payload and length in
+// the log. It returns io.EOF at the end of the log, errTorn for a record
+// cut short by the end of the log, errCorruptHeader for a header that
+// fails its checksum or claims too large a payload and errCorrupt, along
+// with the length of the record, for a payload that fails its checksum.
+func readRecord(r *bufio.Reader) ([]byte, int64, error) {
+	first, err := r.Peek(1)
+	if errors.Is(err, io.EOF) {
+		return nil, 0, io.EOF
+	} else if err != nil {
+		return nil, 0, err
+	}
+
+	if first[0] == legacyRecordStart {
+		line, err := r.ReadBytes('\n')
+		if errors.Is(err, io.EOF) {
+			return nil, 0, errTorn
+		} else if err != nil {
+			return nil, 0, err
+		}
+		return line[:len(line)-1], int64(len(line)), nil
+	}
+
+	var header [headerSize]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, 0, tornOr(err)
+	}
+	if crc32.Checksum(header[:8], crcTable) != binary.BigEndian.Uint32(header[8:]) {
+		return nil, 0, errCorruptHeader
+	}
+	length := binary.BigEndian.Uint32(header[:4])
+	if length > MaxRecordSize {
+		return nil, 0, errCorruptHeader
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, 0, tornOr(err)
+	}
+	if crc32.Checksum(payload, crcTable) != binary.BigEndian.Uint32(header[4:8]) {
+		return nil, headerSize + int64(length), errCorrupt
+	}
+	return payload, headerSize + int64(length), nil
+}
+
+func tornOr(err error) error {
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return errTorn
+	}
+	return err
+}
+
+// Rename atomically replaces newPath with oldPath and syncs their
+// directory, so that the rename survives a crash.
+func Rename(oldPath, newPath string) error {
+	if err := os.Rename(oldPath, newPath); err != nil {
+		return err
+	}
+	dir, err := os.Open(filepath.Dir(newPath))
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	return dir.Sync()
+}
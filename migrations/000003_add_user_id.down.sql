@@ -0,0 +1,2 @@
+ALTER TABLE shorten_url
+DROP COLUMN user_id;
\ No newline at end of file
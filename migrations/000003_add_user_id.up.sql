@@ -0,0 +1,2 @@
+ALTER TABLE shorten_url
+ADD COLUMN user_id TEXT NOT NULL DEFAULT '';
\ No newline at end of file
@@ -0,0 +1 @@
+DROP INDEX user_id_idx;
\ No newline at end of file
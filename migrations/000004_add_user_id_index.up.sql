@@ -0,0 +1 @@
+CREATE INDEX user_id_idx ON shorten_url (user_id);
\ No newline at end of file
@@ -0,0 +1,2 @@
+ALTER TABLE shorten_url
+DROP COLUMN is_deleted;
\ No newline at end of file
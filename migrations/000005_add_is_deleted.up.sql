@@ -0,0 +1,2 @@
+ALTER TABLE shorten_url
+ADD COLUMN is_deleted BOOLEAN NOT NULL DEFAULT FALSE;
\ No newline at end of file
@@ -0,0 +1,3 @@
+DROP INDEX expires_at_idx;
+ALTER TABLE shorten_url
+DROP COLUMN expires_at;
\ No newline at end of file
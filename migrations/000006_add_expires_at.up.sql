@@ -0,0 +1,3 @@
+ALTER TABLE shorten_url
+ADD COLUMN expires_at TIMESTAMPTZ;
+CREATE INDEX expires_at_idx ON shorten_url (expires_at) WHERE expires_at IS NOT NULL;
\ No newline at end of file
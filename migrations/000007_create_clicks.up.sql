@@ -0,0 +1,9 @@
+CREATE TABLE clicks (
+    id BIGSERIAL PRIMARY KEY,
+    alias TEXT NOT NULL,
+    clicked_at TIMESTAMPTZ NOT NULL,
+    referrer TEXT NOT NULL DEFAULT '',
+    user_agent TEXT NOT NULL DEFAULT '',
+    ip TEXT NOT NULL DEFAULT ''
+);
+CREATE INDEX clicks_alias_clicked_at_idx ON clicks (alias, clicked_at);
\ No newline at end of file
@@ -0,0 +1,3 @@
+DROP INDEX long_url_live_idx;
+ALTER TABLE shorten_url
+ADD CONSTRAINT long_url_unique_constraint UNIQUE (long_url);
\ No newline at end of file
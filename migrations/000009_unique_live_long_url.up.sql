@@ -0,0 +1,3 @@
+ALTER TABLE shorten_url
+DROP CONSTRAINT long_url_unique_constraint;
+CREATE UNIQUE INDEX long_url_live_idx ON shorten_url (long_url) WHERE NOT is_deleted;
\ No newline at end of file
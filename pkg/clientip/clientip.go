@@ -0,0 +1,129 @@
+package clientip
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+const (
+	ipv4KeepBits = 24
+	ipv6KeepBits = 48
+)
+
+type ctxKey struct{}
+
+// Resolver finds the client address of requests. Forwarding headers are
+// only believed when the request comes from a trusted proxy.
+type Resolver struct {
+	trusted []*net.IPNet
+}
+
+// NewResolver trusts proxies in the given CIDR ranges or at the given
+// addresses. Without any, forwarding headers are ignored.
+func NewResolver(trustedProxies ...string) (*Resolver, error) {
+	res := &Resolver{}
+	for _, proxy := range trustedProxies {
+		proxy = strings.TrimSpace(proxy)
+		if proxy == "" {
+			continue
+		}
+		if !strings.Contains(proxy, "/") {
+			ip := net.ParseIP(proxy)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid trusted proxy %q", proxy)
+			}
+			bits := 8 * net.IPv6len
+			if v4 := ip.To4(); v4 != nil {
+				ip, bits = v4, 8*net.IPv4len
+			}
+			res.trusted = append(res.trusted, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(proxy)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy %q: %w", proxy, err)
+		}
+		res.trusted = append(res.trusted, network)
+	}
+	return res, nil
+}
+
+// Resolve returns the client address of r. If r comes from a trusted
+// proxy, the client is the last hop of X-Forwarded-For that is not a
+// trusted proxy itself, or X-Real-IP without X-Forwarded-For.
+func (res *Resolver) Resolve(r *http.Request) string {
+	peer := remoteHost(r)
+	if !res.isTrusted(peer) {
+		return peer
+	}
+
+	if forwarded := r.Header.Values("X-Forwarded-For"); len(forwarded) > 0 {
+		hops := strings.Split(strings.Join(forwarded, ","), ",")
+		for i := len(hops) - 1; i >= 0; i-- {
+			ip := net.ParseIP(strings.TrimSpace(hops[i]))
+			if ip == nil {
+				// Anything before a malformed hop may be forged.
+				return peer
+			}
+			if !res.isTrusted(ip.String()) {
+				return ip.String()
+			}
+		}
+		return peer
+	}
+	if realIP := net.ParseIP(r.Header.Get("X-Real-IP")); realIP != nil {
+		return realIP.String()
+	}
+	return peer
+}
+
+func (res *Resolver) isTrusted(addr string) bool {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return false
+	}
+	for _, network := range res.trusted {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// WithAddr stores the resolved client address.
+func WithAddr(ctx context.Context, addr string) context.Context {
+	return context.WithValue(ctx, ctxKey{}, addr)
+}
+
+// FromRequest returns the client address resolved for r, or the
+// connection's remote address if it has not been resolved.
+func FromRequest(r *http.Request) string {
+	if addr, ok := r.Context().Value(ctxKey{}).(string); ok {
+		return addr
+	}
+	return remoteHost(r)
+}
+
+func remoteHost(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// Anonymize zeroes the host part of addr: the last octet of an IPv4
+// address or everything after the /48 prefix of an IPv6 one.
+func Anonymize(addr string) string {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return ""
+	}
+	if v4 := ip.To4(); v4 != nil {
+		return v4.Mask(net.CIDRMask(ipv4KeepBits, 32)).String()
+	}
+	return ip.Mask(net.CIDRMask(ipv6KeepBits, 128)).String()
+}
@@ -4,14 +4,22 @@ import (
 	"math/rand/v2"
 )
 
-const letters = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ"
+const (
+	letters = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ"
+	Base62  = "0123456789" + letters
+)
 
 func RandomString(length int) string {
+	return StringFrom(letters, length)
+}
+
+// StringFrom returns a random string of length symbols taken from alphabet.
+func StringFrom(alphabet string, length int) string {
 	str := make([]byte, length)
 
 	for i := 0; i < length; i++ {
-		j := rand.IntN(len(letters))
-		str[i] = letters[j]
+		j := rand.IntN(len(alphabet))
+		str[i] = alphabet[j]
 	}
 
 	return string(str)
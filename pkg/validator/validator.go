@@ -2,6 +2,11 @@ package validator
 
 import "net/url"
 
+const (
+	minAliasLength = 3
+	maxAliasLength = 64
+)
+
 func IsValidURL(checkableURL string) bool {
 	u, err := url.Parse(checkableURL)
 	if err != nil {
@@ -14,3 +19,19 @@ func IsValidURL(checkableURL string) bool {
 
 	return true
 }
+
+// IsValidAlias reports whether alias consists of latin letters, digits,
+// '-' and '_' only and fits the allowed length.
+func IsValidAlias(alias string) bool {
+	if len(alias) < minAliasLength || len(alias) > maxAliasLength {
+		return false
+	}
+	for _, c := range alias {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9', c == '-', c == '_':
+		default:
+			return false
+		}
+	}
+	return true
+}